@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAPILimit = 100
+	maxAPILimit     = 1000
+)
+
+// registerAPI adds the state API to mux. If c.APIToken is set every request
+// must carry it as a bearer token. Without a token the API is read-only.
+func (c *Config) registerAPI(mux *http.ServeMux) {
+	if c.APIToken != "" {
+		mux.Handle("POST /api/pause", c.requireToken(http.HandlerFunc(c.handlePause)))
+		mux.Handle("POST /api/resume", c.requireToken(http.HandlerFunc(c.handleResume)))
+	}
+	mux.Handle("GET /api/seen", c.requireToken(http.HandlerFunc(c.handleSeen)))
+	mux.Handle("GET /api/findings", c.requireToken(http.HandlerFunc(c.handleFindings)))
+	mux.Handle("GET /api/lastrun", c.requireToken(http.HandlerFunc(handleLastRun)))
+	mux.Handle("GET /api/runs", c.requireToken(http.HandlerFunc(handleRuns)))
+}
+
+func (c *Config) requireToken(next http.Handler) http.Handler {
+	if c.APIToken == "" {
+		return next
+	}
+	want := []byte("Bearer " + c.APIToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("www-authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleSeen lists the packages most recently sent to the scanner, optionally
+// for a single target.
+func (c *Config) handleSeen(w http.ResponseWriter, r *http.Request) {
+	c.listSeen(w, r, SeenFilter{Target: r.URL.Query().Get("target")})
+}
+
+// handleFindings lists the findings recorded, most recent first, optionally
+// for a single target, scored at least min_score or made between since and
+// until, given in RFC 3339 format.
+func (c *Config) handleFindings(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := FindingFilter{Target: q.Get("target")}
+	var ok bool
+	if f.Limit, ok = parseLimit(w, r); !ok {
+		return
+	}
+	if v := q.Get("min_score"); v != "" {
+		var err error
+		if f.MinScore, err = strconv.ParseFloat(v, 64); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "min_score must be a number"})
+			return
+		}
+	}
+	for _, t := range []struct {
+		param string
+		into  *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		v := q.Get(t.param)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *t.into, err = time.Parse(time.RFC3339, v); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": t.param + " must be an RFC 3339 time"})
+			return
+		}
+	}
+	records, err := c.Store.Findings(f)
+	if err != nil {
+		slog.Error("listing findings", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "listing findings failed"})
+		return
+	}
+	if records == nil {
+		records = []FindingRecord{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+func (c *Config) listSeen(w http.ResponseWriter, r *http.Request, f SeenFilter) {
+	var ok bool
+	if f.Limit, ok = parseLimit(w, r); !ok {
+		return
+	}
+	records, err := c.Store.List(f)
+	if err != nil {
+		slog.Error("listing seen packages", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "listing seen packages failed"})
+		return
+	}
+	if records == nil {
+		records = []SeenRecord{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// handleLastRun returns the summary of the last run of each target, or of the
+// single target given.
+func handleLastRun(w http.ResponseWriter, r *http.Request) {
+	summaries := lastSummaries.get()
+	if target := r.URL.Query().Get("target"); target != "" {
+		s, ok := summaries[target]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no run recorded for " + target})
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+		return
+	}
+	if summaries == nil {
+		summaries = map[string]*RunSummary{}
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// handleRuns returns the most recent run summaries kept in memory, newest
+// first, optionally for a single target.
+func handleRuns(w http.ResponseWriter, r *http.Request) {
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, recentRuns.get(r.URL.Query().Get("target"), limit))
+}
+
+// handlePause stops scheduled runs from starting until handleResume is
+// called, for example during scanner maintenance. Runs in progress finish.
+func (c *Config) handlePause(w http.ResponseWriter, r *http.Request) {
+	c.setPaused(w, true)
+}
+
+func (c *Config) handleResume(w http.ResponseWriter, r *http.Request) {
+	c.setPaused(w, false)
+}
+
+// setPaused records p as the paused state, in the state file if there is one
+// so that it survives a restart.
+func (c *Config) setPaused(w http.ResponseWriter, p bool) {
+	paused.Store(p)
+	if err := c.State.SetPaused(p); err != nil {
+		slog.Error("saving paused state", "error", err)
+	}
+	if p {
+		slog.Info("scheduled runs paused through the API")
+	} else {
+		slog.Info("scheduled runs resumed through the API")
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": p})
+}
+
+// parseLimit returns the limit query parameter, or the default if there is
+// none. If it is invalid it writes an error response and returns false.
+func parseLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultAPILimit, true
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be a positive integer"})
+		return 0, false
+	}
+	return min(limit, maxAPILimit), true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("writing API response", "error", err)
+	}
+}
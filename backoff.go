@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBackoffAfter = 3
+	defaultBackoffMax   = Duration(24 * time.Hour)
+)
+
+// backoffSlack lets a scheduled tick that fires slightly early, for example
+// because the previous run was delayed by jitter, still count as due.
+const backoffSlack = time.Minute
+
+// runBackoff widens the effective interval of targets whose scheduled runs
+// keep failing, so that an upstream outage is not met with a request burst
+// every interval. It backs adaptive_backoff.
+var runBackoff adaptiveBackoff
+
+type adaptiveBackoff struct {
+	mu      sync.Mutex
+	targets map[string]*backoffState
+}
+
+type backoffState struct {
+	failures int
+	// next is when the next scheduled run may go ahead.
+	next time.Time
+}
+
+// due reports whether a scheduled run of target may start at now.
+func (b *adaptiveBackoff) due(target string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.targets[target]
+	return !ok || !now.Before(s.next.Add(-backoffSlack))
+}
+
+// recordBackoff updates target's backoff after a scheduled run that started at
+// start. After c.BackoffAfter consecutive failures the interval doubles with
+// every further failure, up to c.BackoffMax; a success restores it.
+func (c *Config) recordBackoff(t Target, start time.Time, err error) {
+	b := &runBackoff
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.targets[t.Name]
+	if err == nil {
+		if ok && s.failures >= c.BackoffAfter {
+			slog.Info("run succeeded, restoring interval", "target", t.Name, "interval", t.IntervalHrs.Duration())
+		}
+		delete(b.targets, t.Name)
+		return
+	}
+	if !ok {
+		if b.targets == nil {
+			b.targets = make(map[string]*backoffState)
+		}
+		s = &backoffState{}
+		b.targets[t.Name] = s
+	}
+	s.failures++
+	if s.failures < c.BackoffAfter {
+		return
+	}
+	interval := t.IntervalHrs.Duration()
+	for range s.failures - c.BackoffAfter + 1 {
+		interval *= 2
+		if interval >= time.Duration(c.BackoffMax) {
+			interval = time.Duration(c.BackoffMax)
+			break
+		}
+	}
+	s.next = start.Add(interval)
+	slog.Warn("runs keep failing, widening interval", "target", t.Name, "failures", s.failures,
+		"interval", interval, "next_run", s.next.UTC())
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errBatchUnsupported is returned by SubmitBatch when the scanner has no batch
+// endpoint.
+var errBatchUnsupported = errors.New("scanner does not support batches")
+
+// batchLinger is how long a batch waits to fill before it is sent anyway, so
+// that the last packages of a run are not held back.
+const batchLinger = time.Second
+
+// BatchSubmitter submits several packages in a single request.
+type BatchSubmitter interface {
+	SubmitBatch(ctx context.Context, packageNames []string) ([]*ScanResult, []error, error)
+}
+
+// batchScanner gathers concurrent Submit calls into batches of up to size
+// packages for batch. Each caller still gets its own result or error, so
+// retries and the dead-letter file work per package as they do without
+// batching. If batch turns out to have no batch endpoint, it falls back to
+// submitting packages one at a time through the embedded Scanner.
+type batchScanner struct {
+	Scanner
+	batch       BatchSubmitter
+	size        int
+	unsupported atomic.Bool
+
+	mu   sync.Mutex
+	open *pendingBatch
+}
+
+// pendingBatch is a batch being filled or in flight. Its results are set
+// before done is closed.
+type pendingBatch struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	names  []string
+	// waiting is the number of callers still waiting for the batch. When it
+	// drops to zero the request is canceled. It is guarded by the
+	// batchScanner's mu.
+	waiting int
+	done    chan struct{}
+	results []*ScanResult
+	errs    []error
+	err     error
+}
+
+func newBatchScanner(s Scanner, batch BatchSubmitter, size int) *batchScanner {
+	return &batchScanner{Scanner: s, batch: batch, size: size}
+}
+
+// Submit adds packageName to the open batch and waits for that batch's result
+// or for ctx to be done.
+func (b *batchScanner) Submit(ctx context.Context, packageName string) (*ScanResult, error) {
+	if b.unsupported.Load() {
+		return b.Scanner.Submit(ctx, packageName)
+	}
+	pb, i := b.enqueue(ctx, packageName)
+	select {
+	case <-pb.done:
+	case <-ctx.Done():
+		b.abandon(pb)
+		return nil, ctx.Err()
+	}
+	var se *statusError
+	switch {
+	case errors.Is(pb.err, errBatchUnsupported):
+		return b.Scanner.Submit(ctx, packageName)
+	case errors.As(pb.err, &se) && se.code < 500:
+		// the scanner refused the batch as a whole, perhaps over one
+		// package in it; submitted alone, each gets its own answer
+		return b.Scanner.Submit(ctx, packageName)
+	case pb.err != nil:
+		return nil, pb.err
+	}
+	return pb.results[i], pb.errs[i]
+}
+
+// enqueue adds packageName to the open batch, opening one if there is none,
+// and returns the batch and the package's index in it. A full batch is sent
+// straight away; otherwise it is sent once batchLinger has passed.
+func (b *batchScanner) enqueue(ctx context.Context, packageName string) (*pendingBatch, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open == nil {
+		// the request outlives the caller that opened the batch, and is
+		// only canceled once every caller has given up on it
+		bctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		pb := &pendingBatch{ctx: bctx, cancel: cancel, done: make(chan struct{})}
+		b.open = pb
+		time.AfterFunc(batchLinger, func() { b.flush(pb) })
+	}
+	pb := b.open
+	pb.names = append(pb.names, packageName)
+	pb.waiting++
+	if len(pb.names) >= b.size {
+		b.open = nil
+		go b.send(pb)
+	}
+	return pb, len(pb.names) - 1
+}
+
+// flush sends pb if it is still open.
+func (b *batchScanner) flush(pb *pendingBatch) {
+	b.mu.Lock()
+	if b.open != pb {
+		// already sent when it filled up
+		b.mu.Unlock()
+		return
+	}
+	b.open = nil
+	b.mu.Unlock()
+	b.send(pb)
+}
+
+func (b *batchScanner) abandon(pb *pendingBatch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pb.waiting--
+	if pb.waiting == 0 {
+		pb.cancel()
+	}
+}
+
+func (b *batchScanner) send(pb *pendingBatch) {
+	defer pb.cancel()
+	pb.results, pb.errs, pb.err = b.batch.SubmitBatch(pb.ctx, pb.names)
+	if errors.Is(pb.err, errBatchUnsupported) && b.unsupported.CompareAndSwap(false, true) {
+		slog.Warn("scanner has no batch endpoint, submitting packages one at a time", "scanner", redactUserinfo(b.Name()))
+	}
+	close(pb.done)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = Duration(time.Minute)
+)
+
+// breakerScanner wraps a Scanner in a circuit breaker. After failures
+// consecutive failed requests the circuit opens and submissions fail at once,
+// without a request, until cooldown has passed and a probe request succeeds.
+// Only outages count as failures: a scanner that rejects a single package
+// is still up.
+type breakerScanner struct {
+	Scanner
+	cb *gobreaker.CircuitBreaker
+}
+
+func newBreakerScanner(s Scanner, failures int, cooldown time.Duration) *breakerScanner {
+	scannerCircuitState.WithLabelValues(s.Name()).Set(float64(gobreaker.StateClosed))
+	return &breakerScanner{
+		Scanner: s,
+		cb: gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:    s.Name(),
+			Timeout: cooldown,
+			ReadyToTrip: func(counts gobreaker.Counts) bool {
+				return counts.ConsecutiveFailures >= uint32(failures)
+			},
+			IsSuccessful: func(err error) bool {
+				return err == nil || !errors.Is(err, ErrUpstreamUnavailable)
+			},
+			OnStateChange: func(name string, from, to gobreaker.State) {
+				scannerCircuitState.WithLabelValues(name).Set(float64(to))
+				level := slog.LevelInfo
+				if to == gobreaker.StateOpen {
+					level = slog.LevelWarn
+				}
+				slog.Log(context.Background(), level, "scanner circuit breaker changed state",
+					"scanner", name, "from", from.String(), "to", to.String())
+			},
+		}),
+	}
+}
+
+// Submit submits packageName unless the circuit is open, in which case it
+// returns an ErrUpstreamUnavailable straight away.
+func (b *breakerScanner) Submit(ctx context.Context, packageName string) (*ScanResult, error) {
+	v, err := b.cb.Execute(func() (any, error) {
+		return b.Scanner.Submit(ctx, packageName)
+	})
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		return nil, fmt.Errorf("%w: %s: %w", ErrUpstreamUnavailable, redactUserinfo(b.Name()), err)
+	}
+	result, _ := v.(*ScanResult)
+	return result, err
+}
+
+// circuitStates returns the circuit breaker state of each scanner, for the
+// health check.
+func (c *Config) circuitStates() map[string]string {
+	states := make(map[string]string)
+	for _, s := range c.Scanners {
+		if b, ok := s.(*breakerScanner); ok {
+			states[b.Name()] = b.cb.State().String()
+		}
+	}
+	return states
+}
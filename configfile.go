@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configFormat returns the format of the config file at path: format if it is
+// set, otherwise one inferred from the extension. Files with any other
+// extension, including the default .config, are JSON.
+func configFormat(path, format string) (string, error) {
+	switch format {
+	case "json", "yaml", "toml":
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("config format must be json, yaml or toml, got %q", format)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml", nil
+	case ".toml":
+		return "toml", nil
+	}
+	return "json", nil
+}
+
+// decodeConfig decodes b in format into c. YAML and TOML are decoded into a
+// generic map first and then re-encoded as JSON, so that the JSON field names
+// and the custom JSON decoding of Hours, Duration and the rest apply to every
+// format alike.
+func decodeConfig(b []byte, format string, c *Config) error {
+	var raw map[string]any
+	switch format {
+	case "yaml":
+		if err := yaml.Unmarshal(b, &raw); err != nil {
+			return err
+		}
+	case "toml":
+		if err := toml.Unmarshal(b, &raw); err != nil {
+			return err
+		}
+	default:
+		return json.Unmarshal(b, c)
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return fmt.Errorf("converting %s to JSON: %w", format, err)
+	}
+	return json.Unmarshal(b, c)
+}
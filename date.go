@@ -0,0 +1,48 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// relDate matches the relative publish dates npm shows, such as "3 hours ago"
+// or "a day ago".
+var relDate = regexp.MustCompile(`^(a|an|\d+) (second|minute|hour|day|week|month|year)s? ago$`)
+
+var relUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+	"month":  30 * 24 * time.Hour,
+	"year":   365 * 24 * time.Hour,
+}
+
+// estimate returns the unix millisecond timestamp that d.Rel describes,
+// relative to now, for when TS is missing. "3 hours ago" covers anything from
+// three to four hours ago; the most recent end is returned, so that an estimate
+// errs towards putting a package inside the window rather than outside it.
+func (d Date) estimate(now time.Time) (int64, bool) {
+	rel := strings.ToLower(strings.TrimSpace(d.Rel))
+	switch rel {
+	case "just now", "a few seconds ago":
+		return now.UnixMilli(), true
+	case "yesterday":
+		return now.Add(-relUnits["day"]).UnixMilli(), true
+	}
+	m := relDate.FindStringSubmatch(rel)
+	if m == nil {
+		return 0, false
+	}
+	n := 1
+	if m[1] != "a" && m[1] != "an" {
+		var err error
+		if n, err = strconv.Atoi(m[1]); err != nil {
+			return 0, false
+		}
+	}
+	return now.Add(-time.Duration(n) * relUnits[m[2]]).UnixMilli(), true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultDeadLetterMax is the number of entries the dead-letter file holds
+// before it is rotated.
+const defaultDeadLetterMax = 1000
+
+// DeadLetter records packages whose submission to the scanner failed for
+// good, so that they can be sent again with --retry-dead-letter once the
+// problem is fixed. It is persisted as a JSON file. When it reaches max
+// entries the file is moved aside to path.1, replacing any earlier one, and a
+// new one started. A nil *DeadLetter is valid and records nothing.
+type DeadLetter struct {
+	mu      sync.Mutex
+	path    string
+	max     int
+	Entries []DeadLetterEntry `json:"entries"`
+}
+
+type DeadLetterEntry struct {
+	Target   string    `json:"target"`
+	Package  Package   `json:"package"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// LoadDeadLetter reads the dead-letter file at path. A missing file is
+// treated as empty.
+func LoadDeadLetter(path string, max int) (*DeadLetter, error) {
+	d := &DeadLetter{path: path, max: max}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading dead-letter file: %w", err)
+	}
+	if err := json.Unmarshal(b, d); err != nil {
+		return nil, fmt.Errorf("unmarshalling dead-letter file %s: %w", path, err)
+	}
+	return d, nil
+}
+
+// Add records p as failed with err and writes the file to disk. An earlier
+// entry for the same package version is replaced.
+func (d *DeadLetter) Add(target string, p Package, err error) error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := seenKey(p)
+	d.Entries = slices.DeleteFunc(d.Entries, func(e DeadLetterEntry) bool {
+		return seenKey(e.Package) == key
+	})
+	if len(d.Entries) >= d.max {
+		if err := os.Rename(d.path, d.path+".1"); err != nil {
+			return fmt.Errorf("rotating dead-letter file: %w", err)
+		}
+		slog.Warn("dead-letter file full, rotated", "path", d.path+".1", "entries", len(d.Entries))
+		d.Entries = nil
+	}
+	d.Entries = append(d.Entries, DeadLetterEntry{Target: target, Package: p, Error: err.Error(), FailedAt: time.Now().UTC()})
+	return d.save()
+}
+
+// Take removes and returns every entry, writing the emptied file to disk.
+func (d *DeadLetter) Take() ([]DeadLetterEntry, error) {
+	if d == nil {
+		return nil, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries := d.Entries
+	d.Entries = nil
+	return entries, d.save()
+}
+
+// save writes the file to disk. The caller must hold d.mu.
+func (d *DeadLetter) save() error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("marshalling dead-letter file: %w", err)
+	}
+	if err := writeFileAtomic(d.path, b); err != nil {
+		return fmt.Errorf("writing dead-letter file: %w", err)
+	}
+	return nil
+}
+
+// retryDeadLetter submits every package in the dead-letter file again.
+// Packages that fail again are put back.
+func (c *Config) retryDeadLetter(ctx context.Context) error {
+	entries, err := c.DeadLetter.Take()
+	if err != nil {
+		return err
+	}
+	slog.Info("retrying dead-lettered packages", "count", len(entries))
+	var failed int
+	retries := newRetryBudget(c.RetryBudget)
+	for _, e := range entries {
+		if _, err := c.sendToScanner(ctx, e.Target, e.Package, retries); err != nil {
+			failed++
+			logErr(slog.LevelError, "sending dead-lettered package to scanner", err, "target", e.Target, "package", e.Package.Name)
+			if err := c.DeadLetter.Add(e.Target, e.Package, err); err != nil {
+				slog.Error("recording dead-lettered package", "package", seenKey(e.Package), "error", err)
+			}
+		}
+	}
+	if err := c.Output.Flush(); err != nil {
+		slog.Error("flushing output file", "error", err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d dead-lettered packages failed again", failed, len(entries))
+	}
+	return nil
+}
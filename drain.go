@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errShuttingDown is returned for submissions attempted after shutdown has
+// begun.
+var errShuttingDown = errors.New("shutting down")
+
+// submissions tracks scanner submissions in flight so that shutdown can give
+// them a chance to finish.
+var submissions submissionTracker
+
+type submissionTracker struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	inflight int
+}
+
+// start registers a new submission. It returns false once draining has
+// begun, in which case the submission must not be made. Every successful call
+// must be paired with a call to done.
+func (t *submissionTracker) start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.inflight++
+	t.wg.Add(1)
+	return true
+}
+
+func (t *submissionTracker) done() {
+	t.mu.Lock()
+	t.inflight--
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// stopped reports whether draining has begun.
+func (t *submissionTracker) stopped() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// drain stops new submissions from starting and waits up to grace for those
+// in flight to finish. It returns how many were in flight when draining began
+// and how many of those completed.
+func (t *submissionTracker) drain(grace time.Duration) (inflight, completed int) {
+	t.mu.Lock()
+	t.draining = true
+	inflight = t.inflight
+	t.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(grace):
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return inflight, inflight - t.inflight
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// envPrefix is prepended to the upper-cased JSON name of a config field to
+// give the environment variable that overrides it, e.g. NPMWATCHER_SCANNER_URL
+// for scanner_url.
+const envPrefix = "NPMWATCHER_"
+
+// hasEnvConfig reports whether any config field is set in the environment.
+func hasEnvConfig() bool {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyEnv overrides config fields with NPMWATCHER_* environment variables.
+// Values are decoded as JSON where possible, so numbers, booleans and arrays
+// work, and are otherwise taken as plain strings. Targets and scanner URLs may
+// also be given as comma-separated lists.
+func (c *Config) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		env := envPrefix + strings.ToUpper(name)
+		raw, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if targets, ok := v.Field(i).Addr().Interface().(*Targets); ok && !strings.HasPrefix(raw, "[") {
+			*targets = nil
+			for _, name := range strings.Split(raw, ",") {
+				*targets = append(*targets, Target{Name: name})
+			}
+			continue
+		}
+		if urls, ok := v.Field(i).Addr().Interface().(*URLs); ok && !strings.HasPrefix(raw, "[") {
+			*urls = strings.Split(raw, ",")
+			continue
+		}
+		field := v.Field(i).Addr().Interface()
+		if err := json.Unmarshal([]byte(raw), field); err != nil {
+			quoted, _ := json.Marshal(raw)
+			if err := json.Unmarshal(quoted, field); err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+	return nil
+}
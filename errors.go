@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors returned by the triage pipeline fall into these classes. They are
+// wrapped, so check for them with errors.Is.
+var (
+	// ErrUnauthorized is returned when the scanner rejects the API key.
+	// Retrying will not help.
+	ErrUnauthorized = errors.New("api key was rejected by the scanner")
+	// ErrUpstreamUnavailable is returned when npm or the scanner could not be
+	// reached, rate limited the request or responded with a 5xx. It is
+	// usually transient.
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	// ErrDecodeFailure is returned when a response body is not what was
+	// expected, such as truncated or invalid JSON.
+	ErrDecodeFailure = errors.New("malformed response")
+	// ErrAPIChanged is returned when the npm browse endpoint responds with
+	// something other than JSON, as it does if it stops honouring the
+	// x-spiferack header. Retrying will not help.
+	ErrAPIChanged = errors.New("the browse API may have changed")
+	// ErrTargetMismatch is returned when npm lists the dependents of a
+	// different package from the one asked for.
+	ErrTargetMismatch = errors.New("response is for a different dependency")
+)
+
+// errorClass names the class of err for logs and the health check, or returns
+// "" if it has none.
+func errorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, ErrAPIChanged):
+		return "api_changed"
+	case errors.Is(err, ErrTargetMismatch):
+		return "target_mismatch"
+	case errors.Is(err, ErrDecodeFailure):
+		return "decode_failure"
+	case errors.Is(err, ErrUpstreamUnavailable):
+		return "upstream_unavailable"
+	}
+	return ""
+}
+
+// retryableError marks a scanner failure that is worth retrying, optionally
+// after a delay requested by the server.
+type retryableError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// statusError is returned when an upstream responds with an unexpected HTTP
+// status code. A 5xx status is an ErrUpstreamUnavailable.
+type statusError struct {
+	code int
+	url  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d from %s", e.code, e.url)
+}
+
+func (e *statusError) Is(target error) bool {
+	return target == ErrUpstreamUnavailable && e.code >= 500
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// DependentsFetcher lists the packages that depend on a target.
+type DependentsFetcher interface {
+	// FetchDependents returns one page of dependents of target starting at
+	// offset, along with the total number of dependents.
+	FetchDependents(ctx context.Context, target string, offset int) ([]Package, int, error)
+}
+
+// DownloadCounter looks up how often packages are downloaded.
+type DownloadCounter interface {
+	// WeeklyDownloads returns the number of downloads of name over the last
+	// week.
+	WeeklyDownloads(ctx context.Context, name string) (int64, error)
+}
+
+// NPMFetcher lists dependents using the npmjs.com browse endpoint at BaseURL,
+// which must end in a slash.
+type NPMFetcher struct {
+	BaseURL string
+	// DownloadsURL is the npm downloads API endpoint that WeeklyDownloads
+	// appends package names to. It must end in a slash.
+	DownloadsURL string
+	// MetadataURL is the npm registry that FetchTarball looks up tarballs
+	// in. It must end in a slash.
+	MetadataURL string
+	// MaxTarballBytes is the largest tarball FetchTarball downloads.
+	MaxTarballBytes int64
+	Client          *http.Client
+	// UserAgent identifies the bot to npm.
+	UserAgent string
+	// Limiter, if set, paces requests to npm.
+	Limiter *rate.Limiter
+}
+
+// maxRateLimitRetries is how many times a page is requested again after npm
+// responds 429 before giving up.
+const maxRateLimitRetries = 5
+
+// FetchDependents fetches a single page of dependents of target from the npm
+// browse endpoint, starting at offset. If npm rate limits the request anyway
+// it backs off, honouring Retry-After, and tries again.
+func (f *NPMFetcher) FetchDependents(ctx context.Context, target string, offset int) ([]Package, int, error) {
+	for attempt := 1; ; attempt++ {
+		if f.Limiter != nil {
+			if err := f.Limiter.Wait(ctx); err != nil {
+				return nil, 0, err
+			}
+		}
+		d, err := f.fetchPage(ctx, target, offset)
+		var re *retryableError
+		if !errors.As(err, &re) || attempt > maxRateLimitRetries {
+			if err != nil {
+				return nil, 0, err
+			}
+			return d.Packages, d.Total, nil
+		}
+		delay := re.after
+		if delay == 0 {
+			delay = time.Second << attempt
+		}
+		slog.Warn("rate limited by npm, backing off", "target", target, "offset", offset, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+}
+
+// fetchPage makes a single request for a page of dependents. A 429 response is
+// returned as a *retryableError.
+func (f *NPMFetcher) fetchPage(ctx context.Context, target string, offset int) (*Data, error) {
+	u := f.BaseURL + target
+	if offset > 0 {
+		u += "?offset=" + strconv.Itoa(offset)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request for dependency %s: %w", target, err)
+	}
+	req.Header.Add("accept", "application/json")
+	req.Header.Add("x-spiferack", "1")
+	req.Header.Add("user-agent", f.UserAgent)
+	res, err := f.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: doing request for %s: %w", ErrUpstreamUnavailable, redactUserinfo(req.URL.String()), redactURLError(err))
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusTooManyRequests {
+		return nil, &retryableError{
+			err:   fmt.Errorf("%w: rate limited by %s", ErrUpstreamUnavailable, redactUserinfo(res.Request.URL.String())),
+			after: parseRetryAfter(res.Header.Get("retry-after")),
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, &statusError{code: res.StatusCode, url: redactUserinfo(res.Request.URL.String())}
+	}
+	if err := checkJSON(res); err != nil {
+		return nil, err
+	}
+	d, err := decodeData(res.Body)
+	// a read cut short by the run being cancelled is not a decode failure
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w from %s: %w", ErrDecodeFailure, redactUserinfo(res.Request.URL.String()), err)
+	}
+	if d.Dependency != target {
+		return nil, fmt.Errorf("%w: wanted %s, got %s", ErrTargetMismatch, target, d.Dependency)
+	}
+	for _, err := range d.Malformed {
+		slog.Warn("skipping malformed package", "target", target, "offset", offset, "error", err)
+	}
+	return d, nil
+}
+
+// rawData is a page of dependents with its packages left undecoded.
+type rawData struct {
+	Title      string            `json:"title"`
+	Dependency string            `json:"dependency"`
+	Packages   []json.RawMessage `json:"packages"`
+	Total      int               `json:"total"`
+}
+
+// decodeData decodes a page of dependents from r. The page is unmarshalled
+// whole, and only if a package cannot be decoded is it decoded again a package
+// at a time, so that those that cannot be are recorded in Malformed and left
+// out rather than failing the page. Only a syntax error fails it.
+func decodeData(r io.Reader) (*Data, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var d Data
+	err = json.Unmarshal(b, &d)
+	var se *json.SyntaxError
+	switch {
+	case err == nil:
+		return &d, nil
+	case errors.As(err, &se):
+		return nil, err
+	}
+	var raw rawData
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	d = Data{Title: raw.Title, Dependency: raw.Dependency, Total: raw.Total}
+	for i, m := range raw.Packages {
+		var p Package
+		if err := json.Unmarshal(m, &p); err != nil {
+			d.Malformed = append(d.Malformed, fmt.Errorf("package %d: %w", i, err))
+			continue
+		}
+		d.Packages = append(d.Packages, p)
+	}
+	return &d, nil
+}
+
+// bodySnippetBytes is how much of an unexpected response body is logged.
+const bodySnippetBytes = 512
+
+// checkJSON returns an ErrAPIChanged if res declares a content type other than
+// JSON, logging the start of the body to show what npm sent instead.
+func checkJSON(res *http.Response) error {
+	ct := res.Header.Get("content-type")
+	if ct == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+	npmNonJSONResponses.Inc()
+	what := strconv.Quote(ct)
+	if mediaType == "text/html" {
+		what = "HTML"
+	}
+	snippet, _ := io.ReadAll(io.LimitReader(res.Body, bodySnippetBytes))
+	slog.Error("npm did not return JSON", "url", redactUserinfo(res.Request.URL.String()), "content_type", ct, "body", string(snippet))
+	return fmt.Errorf("npm returned %s from %s; %w", what, redactUserinfo(res.Request.URL.String()), ErrAPIChanged)
+}
+
+type downloadsPoint struct {
+	Downloads int64  `json:"downloads"`
+	Package   string `json:"package"`
+}
+
+// WeeklyDownloads looks up name in the npm downloads API, sharing the rate
+// limit with FetchDependents. Packages too new to have been counted yet are
+// reported as never downloaded.
+func (f *NPMFetcher) WeeklyDownloads(ctx context.Context, name string) (int64, error) {
+	if f.Limiter != nil {
+		if err := f.Limiter.Wait(ctx); err != nil {
+			return 0, err
+		}
+	}
+	// the API takes scoped names unescaped, as in @scope/name
+	req, err := http.NewRequestWithContext(ctx, "GET", f.DownloadsURL+name, nil)
+	if err != nil {
+		return 0, fmt.Errorf("creating downloads request for %s: %w", name, err)
+	}
+	req.Header.Add("accept", "application/json")
+	req.Header.Add("user-agent", f.UserAgent)
+	res, err := f.Client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: doing request for %s: %w", ErrUpstreamUnavailable, redactUserinfo(req.URL.String()), redactURLError(err))
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, &statusError{code: res.StatusCode, url: redactUserinfo(res.Request.URL.String())}
+	}
+	var d downloadsPoint
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		return 0, fmt.Errorf("%w from %s: %w", ErrDecodeFailure, redactUserinfo(res.Request.URL.String()), err)
+	}
+	return d.Downloads, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// EcosystemsFetcher lists dependents using the ecosyste.ms packages API at
+// BaseURL, the npmjs.org registry's packages endpoint, which must end in a
+// slash. Unlike the npmjs.com browse endpoint it is documented and versioned,
+// but it lags the registry by up to a day.
+type EcosystemsFetcher struct {
+	BaseURL string
+	// PageSize is the number of dependents requested per page. The offsets
+	// FetchDependents is called with must be multiples of it, as they are
+	// when paging advances by the length of every full page.
+	PageSize int
+	Client   *http.Client
+	// UserAgent identifies the bot to ecosyste.ms.
+	UserAgent string
+	// Limiter, if set, paces requests to ecosyste.ms.
+	Limiter *rate.Limiter
+}
+
+// ecosystemsPackage is the part of an ecosyste.ms package that maps onto
+// Package.
+type ecosystemsPackage struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Version     string    `json:"latest_release_number"`
+	PublishedAt time.Time `json:"latest_release_published_at"`
+	Maintainers []struct {
+		Login string `json:"login"`
+	} `json:"maintainers"`
+}
+
+// FetchDependents fetches a single page of dependents of target, most recently
+// released first. ecosyste.ms does not always report a total, in which case a
+// full page is taken to mean there is another after it. A 429 response is
+// returned as a *retryableError.
+func (f *EcosystemsFetcher) FetchDependents(ctx context.Context, target string, offset int) ([]Package, int, error) {
+	if f.Limiter != nil {
+		if err := f.Limiter.Wait(ctx); err != nil {
+			return nil, 0, err
+		}
+	}
+	q := url.Values{
+		"page":     {strconv.Itoa(offset/f.PageSize + 1)},
+		"per_page": {strconv.Itoa(f.PageSize)},
+		"sort":     {"latest_release_published_at"},
+		"order":    {"desc"},
+	}
+	u := f.BaseURL + url.PathEscape(target) + "/dependent_packages?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating request for dependency %s: %w", target, err)
+	}
+	req.Header.Add("accept", "application/json")
+	req.Header.Add("user-agent", f.UserAgent)
+	res, err := f.Client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: doing request for %s: %w", ErrUpstreamUnavailable, redactUserinfo(req.URL.String()), redactURLError(err))
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusTooManyRequests {
+		return nil, 0, &retryableError{
+			err:   fmt.Errorf("%w: rate limited by %s", ErrUpstreamUnavailable, redactUserinfo(res.Request.URL.String())),
+			after: parseRetryAfter(res.Header.Get("retry-after")),
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, &statusError{code: res.StatusCode, url: redactUserinfo(res.Request.URL.String())}
+	}
+	var page []ecosystemsPackage
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		return nil, 0, fmt.Errorf("%w from %s: %w", ErrDecodeFailure, redactUserinfo(res.Request.URL.String()), err)
+	}
+	packages := make([]Package, 0, len(page))
+	for _, e := range page {
+		p := Package{Name: e.Name, Description: e.Description, Version: e.Version}
+		if !e.PublishedAt.IsZero() {
+			p.Date.TS = e.PublishedAt.UnixMilli()
+		}
+		for _, m := range e.Maintainers {
+			p.Maintainers = append(p.Maintainers, m.Login)
+		}
+		packages = append(packages, p)
+	}
+	total, err := strconv.Atoi(res.Header.Get("total"))
+	if err != nil {
+		total = offset + len(packages)
+		if len(packages) == f.PageSize {
+			total++
+		}
+	}
+	return packages, total, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDecodeData(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		want      []string
+		malformed int
+		wantErr   bool
+	}{
+		{
+			name: "all packages",
+			body: `{"dependency":"foo","total":2,"packages":[{"name":"a"},{"name":"b"}]}`,
+			want: []string{"a", "b"},
+		},
+		{
+			name: "null packages",
+			body: `{"dependency":"foo","total":0,"packages":null}`,
+		},
+		{
+			name: "unknown keys are skipped",
+			body: `{"extra":{"x":[1,2]},"dependency":"foo","packages":[{"name":"a","new":true}]}`,
+			want: []string{"a"},
+		},
+		{
+			name:      "malformed packages are skipped",
+			body:      `{"dependency":"foo","packages":[{"name":"a"},{"name":1},{"name":"c","maintainers":"x"},"d",{"name":"e"}]}`,
+			want:      []string{"a", "e"},
+			malformed: 3,
+		},
+		{
+			name:    "syntax error fails the page",
+			body:    `{"dependency":"foo","packages":[{"name":"a"},{"name":}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "truncated page fails",
+			body:    `{"dependency":"foo","packages":[{"name":"a"},{"na`,
+			wantErr: true,
+		},
+		{
+			name:    "packages not an array",
+			body:    `{"dependency":"foo","packages":{}}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := decodeData(strings.NewReader(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decodeData succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeData: %v", err)
+			}
+			if d.Dependency != "foo" {
+				t.Errorf("Dependency = %q, want foo", d.Dependency)
+			}
+			var got []string
+			for _, p := range d.Packages {
+				got = append(got, p.Name)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("decoded %v, want %v", got, tt.want)
+			}
+			if len(d.Malformed) != tt.malformed {
+				t.Errorf("Malformed = %v, want %d errors", d.Malformed, tt.malformed)
+			}
+		})
+	}
+}
+
+// largePage is a page of n dependents shaped like those npm returns, with the
+// package at malformed, if any, given maintainers that cannot be decoded.
+func largePage(n, malformed int) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `{"title":"dependents","dependency":"foo","total":%d,"packages":[`, n)
+	for i := range n {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		maintainers := `[{"name":"alice","email":"alice@example.com"},"bob"]`
+		if i == malformed {
+			maintainers = `"alice"`
+		}
+		fmt.Fprintf(&b, `{"name":"package-%d","description":"a package that does something with foo, number %d",`+
+			`"maintainers":%s,`+
+			`"publisher":{"name":"alice","avatars":{"small":"https://example.com/s.png","large":"https://example.com/l.png"}},`+
+			`"date":{"ts":%d,"rel":"2 days ago"},"version":"1.0.%d"}`, i, i, maintainers, 1700000000000+i, i)
+	}
+	b.WriteString(`]}`)
+	return b.Bytes()
+}
+
+// BenchmarkDecodeData decodes a page of 10,000 dependents, and the same page
+// with one package that cannot be decoded, which has the page decoded again a
+// package at a time. Measured on one Xeon core, with the publisher's avatars
+// decoded and left out:
+//
+//	                 avatars decoded            avatars left out
+//	valid             83ms  22.4MB  221k allocs   73ms  18.9MB  140k allocs
+//	one malformed    194ms  43.2MB  461k allocs  149ms  36.3MB  301k allocs
+//
+// Leaving out the avatars, which nothing read, saves a map per package.
+// Reading the body into memory accounts for about 7MB of each. Streaming the
+// page through json.Decoder's Token and More instead, keeping only the
+// packages inside a run's window as triage would, halved the memory of
+// unmarshalling but took 30% longer with as many allocations, so pages are
+// unmarshalled whole.
+func BenchmarkDecodeData(b *testing.B) {
+	for _, bb := range []struct {
+		name string
+		page []byte
+	}{
+		{name: "valid", page: largePage(10000, -1)},
+		{name: "one malformed", page: largePage(10000, 5000)},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := decodeData(bytes.NewReader(bb.page)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeFixtures(t *testing.T) {
+	tests := []struct {
+		file      string
+		want      map[string]Maintainers
+		malformed int
+	}{
+		{
+			file: "maintainers_strings.json",
+			want: map[string]Maintainers{
+				"left-foo":         {"alice", "bob"},
+				"@scope/foo-utils": {"carol"},
+			},
+		},
+		{
+			file: "maintainers_objects.json",
+			want: map[string]Maintainers{
+				"left-foo":         {"alice", "bob"},
+				"@scope/foo-utils": {"carol"},
+				"foo-mixed":        {"dave", "erin"},
+			},
+		},
+		{
+			file: "malformed.json",
+			want: map[string]Maintainers{
+				"good-strings": {"alice"},
+				"good-objects": {"bob"},
+			},
+			malformed: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			d, err := decodeData(f)
+			if err != nil {
+				t.Fatalf("decodeData: %v", err)
+			}
+			got := make(map[string]Maintainers)
+			for _, p := range d.Packages {
+				got[p.Name] = p.Maintainers
+			}
+			if !maps.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("decoded maintainers %v, want %v", got, tt.want)
+			}
+			if len(d.Malformed) != tt.malformed {
+				t.Errorf("Malformed = %v, want %d errors", d.Malformed, tt.malformed)
+			}
+		})
+	}
+}
+
+func TestMaintainersUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    Maintainers
+		wantErr bool
+	}{
+		{json: `[]`, want: Maintainers{}},
+		{json: `null`, want: Maintainers{}},
+		{json: `["alice","bob"]`, want: Maintainers{"alice", "bob"}},
+		{json: `[{"name":"alice","email":"a@example.com"}]`, want: Maintainers{"alice"}},
+		{json: `[{"username":"alice"}]`, want: Maintainers{"alice"}},
+		{json: `[{"name":"alice","username":"al"}]`, want: Maintainers{"alice"}},
+		{json: `["alice",{"name":"bob"}]`, want: Maintainers{"alice", "bob"}},
+		{json: `"alice"`, wantErr: true},
+		{json: `{"name":"alice"}`, wantErr: true},
+		{json: `[42]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var got Maintainers
+		err := json.Unmarshal([]byte(tt.json), &got)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("unmarshalling %s = %v, want an error", tt.json, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("unmarshalling %s = %v, %v, want %v", tt.json, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// schedulerRunning is set once the scheduler has started and cleared when it
+// is stopped.
+var schedulerRunning atomic.Bool
+
+// paused is set while scheduled runs are paused through the API.
+var paused atomic.Bool
+
+type healthResponse struct {
+	Status      string     `json:"status"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	ErrorClass  string     `json:"error_class,omitempty"`
+	Paused      bool       `json:"paused,omitempty"`
+	// CircuitBreakers is the state of each scanner's circuit breaker. An
+	// open circuit does not make the bot unhealthy, as restarting it would
+	// not bring the scanner back.
+	CircuitBreakers map[string]string `json:"circuit_breakers,omitempty"`
+}
+
+// newHealthServer returns a server for liveness and readiness probes,
+// Prometheus metrics and the read-only API on c.HealthPort.
+func (c *Config) newHealthServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", c.handleHealthz)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	c.registerAPI(mux)
+	return &http.Server{
+		Addr:              ":" + strconv.Itoa(c.HealthPort),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+// handleHealthz responds 200 while the scheduler is running and the last run
+// succeeded (or none has happened yet), or runs are paused, and 503 otherwise.
+func (c *Config) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	at, lastSuccess, err := lastRun.get()
+	res := healthResponse{Status: "ok", CircuitBreakers: c.circuitStates()}
+	if !at.IsZero() {
+		res.LastRun = &at
+	}
+	if !lastSuccess.IsZero() {
+		res.LastSuccess = &lastSuccess
+	}
+	code := http.StatusOK
+	switch {
+	case !schedulerRunning.Load():
+		code = http.StatusServiceUnavailable
+		res.Status = "scheduler not running"
+	case paused.Load():
+		res.Status = "paused"
+		res.Paused = true
+	case err != nil:
+		code = http.StatusServiceUnavailable
+		res.Status = "last run failed"
+		res.Error = err.Error()
+		res.ErrorClass = errorClass(err)
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		slog.Error("writing health response", "error", err)
+	}
+}
+
+// runHealthcheck probes this process's own /healthz endpoint on port and
+// returns the exit status for it: 0 if healthy, 1 otherwise. It backs the
+// --healthcheck flag, which lets the image health check itself without curl:
+//
+//	HEALTHCHECK CMD ["/app/dep-watcher", "--healthcheck"]
+//
+// The probe must be run with the same config as the bot so that it finds the
+// same health_port.
+func runHealthcheck(port int) int {
+	client := &http.Client{Timeout: 3 * time.Second}
+	res, err := client.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/healthz")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "healthcheck:", err)
+		return 1
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "healthcheck: status code %d: %s", res.StatusCode, body)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// loadIgnoreFile reads the package names and patterns in the ignore file at
+// name, one per line. Blank lines and lines starting with # are skipped.
+// Patterns use path.Match syntax, so @mycorp/* matches every package in the
+// @mycorp scope.
+func loadIgnoreFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("opening ignore file: %w", err)
+	}
+	defer f.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		p := strings.TrimSpace(scanner.Text())
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("ignore file %s line %d: %q: %w", name, line, p, err)
+		}
+		patterns = append(patterns, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading ignore file: %w", err)
+	}
+	return patterns, nil
+}
+
+// ignored reports whether name matches a pattern in the ignore file.
+func (c *Config) ignored(name string) bool {
+	for _, p := range c.Ignore {
+		// validated by loadIgnoreFile
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests in this file run whole triage passes against fake npm and scanner
+// servers, configured through LoadConfig as the bot would be.
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// runs log every package they look at; only show that with -v
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	os.Exit(m.Run())
+}
+
+// fixedClock is a Clock stopped at a single time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+// testNow is the time runs in these tests start at.
+var testNow = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// ago returns the publish timestamp of a package published d before testNow.
+func ago(d time.Duration) Date {
+	return Date{TS: testNow.Add(-d).UnixMilli()}
+}
+
+// fakeNPM serves the npm browse endpoint for target, listing packages in pages
+// of pageSize as npm does.
+type fakeNPM struct {
+	*httptest.Server
+	target   string
+	pageSize int
+
+	mu       sync.Mutex
+	packages []Package
+	// others, if set, holds the dependents of targets other than target.
+	others  map[string][]Package
+	offsets []int
+	// fail, if set, returns the status to respond to the page at offset
+	// with in place of the page, or 0 to serve it.
+	fail func(offset int) int
+}
+
+func newFakeNPM(t *testing.T, target string, packages ...Package) *fakeNPM {
+	t.Helper()
+	f := &fakeNPM{target: target, pageSize: defaultPageSize, packages: packages}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeNPM) serve(w http.ResponseWriter, r *http.Request) {
+	target := strings.TrimPrefix(r.URL.Path, "/")
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	packages, ok := f.others[target]
+	if target == f.target {
+		packages, ok = f.packages, true
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f.offsets = append(f.offsets, offset)
+	if f.fail != nil {
+		if code := f.fail(offset); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+	}
+	page := Data{Dependency: target, Total: len(packages), Packages: []Package{}}
+	if offset < len(packages) {
+		page.Packages = packages[offset:min(offset+f.pageSize, len(packages))]
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// requested returns the offsets of the pages that have been requested, in
+// order.
+func (f *fakeNPM) requested() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.offsets...)
+}
+
+// fakeScanner serves the scanner API under /scan/, answering every package
+// with a benign verdict unless respond says otherwise.
+type fakeScanner struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []string
+	// respond, if set, returns the status to answer the nth request, from
+	// 1, for name with.
+	respond func(name string, n int) int
+}
+
+func newFakeScanner(t *testing.T) *fakeScanner {
+	t.Helper()
+	s := &fakeScanner{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeScanner) serve(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutPrefix(r.URL.Path, "/scan/")
+	if !ok || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, name)
+	n := 0
+	for _, req := range s.requests {
+		if req == name {
+			n++
+		}
+	}
+	respond := s.respond
+	s.mu.Unlock()
+	if respond != nil {
+		if code := respond(name, n); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(ScanResult{Verdict: "benign"})
+}
+
+// submitted returns the package names the scanner has been sent, in order.
+func (s *fakeScanner) submitted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// count returns how many times name has been sent to the scanner.
+func (s *fakeScanner) count(name string) int {
+	n := 0
+	for _, req := range s.submitted() {
+		if req == name {
+			n++
+		}
+	}
+	return n
+}
+
+// harness is a bot pointed at a fake npm and scanner, with its store and run
+// state in a temporary directory.
+type harness struct {
+	t       *testing.T
+	dir     string
+	npm     *fakeNPM
+	scanner *fakeScanner
+}
+
+func newHarness(t *testing.T, packages ...Package) *harness {
+	t.Helper()
+	return &harness{
+		t:       t,
+		dir:     t.TempDir(),
+		npm:     newFakeNPM(t, "foo", packages...),
+		scanner: newFakeScanner(t),
+	}
+}
+
+// load writes a config file for the fake servers, with extra fields added to
+// or replacing the defaults, or removed where they are nil, and loads it with
+// LoadConfig.
+func (h *harness) load(extra map[string]any) (*Config, error) {
+	h.t.Helper()
+	fields := map[string]any{
+		"apikey":           "test-key",
+		"target":           []string{h.npm.target},
+		"interval":         2,
+		"registry_url":     h.npm.URL + "/",
+		"scanner_url":      h.scanner.URL + "/scan/",
+		"store_path":       filepath.Join(h.dir, "seen.json"),
+		"state_file":       filepath.Join(h.dir, "state.json"),
+		"retry_base_delay": "1ms",
+		"retry_max_delay":  "1ms",
+	}
+	for k, v := range extra {
+		fields[k] = v
+		if v == nil {
+			delete(fields, k)
+		}
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	path := filepath.Join(h.dir, "config.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		h.t.Fatal(err)
+	}
+	return LoadConfig(path, "")
+}
+
+// config loads a config as load does and wires it up as main does, minus the
+// startup ping, with the clock stopped at testNow. Each call loads the store
+// and state left by the last.
+func (h *harness) config(extra map[string]any) *Config {
+	h.t.Helper()
+	c, err := h.load(extra)
+	if err != nil {
+		h.t.Fatalf("LoadConfig: %v", err)
+	}
+
+	c.Clock = fixedClock(testNow)
+	c.Client = &http.Client{
+		Timeout: time.Duration(c.HTTPTimeout),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	c.Fetcher = &NPMFetcher{BaseURL: c.RegistryURL, Client: c.Client, UserAgent: c.UserAgent}
+	for _, u := range c.ScannerURL {
+		scanner := &HTTPScanner{BaseURL: u, ApiKey: c.ApiKey, AuthScheme: c.AuthScheme, UserAgent: c.UserAgent, Client: c.Client}
+		var s Scanner = scanner
+		if c.BatchSize > 0 {
+			s = newBatchScanner(scanner, scanner, c.BatchSize)
+		}
+		c.Scanners = append(c.Scanners, newBreakerScanner(s, c.BreakerFailures, time.Duration(c.BreakerCooldown)))
+	}
+	if c.Store, err = OpenStore(c.StoreKind, c.StorePath); err != nil {
+		h.t.Fatal(err)
+	}
+	h.t.Cleanup(func() { c.Store.Close() })
+	if c.State, err = LoadRunState(c.StateFile); err != nil {
+		h.t.Fatal(err)
+	}
+	return c
+}
+
+// run runs a single triage pass of every target of c.
+func (h *harness) run(c *Config) error {
+	h.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return c.runTriage(ctx, c.Target)
+}
+
+func TestIntegration(t *testing.T) {
+	tests := []struct {
+		name     string
+		packages []Package
+		respond  func(name string, n int) int
+		// wantRequests is how many times each package is sent
+		wantRequests map[string]int
+		wantErr      error
+		// wantLastRun is whether the run moves the cutoff for the next
+		wantLastRun bool
+	}{
+		{
+			name:         "no dependents",
+			wantRequests: map[string]int{},
+			wantLastRun:  true,
+		},
+		{
+			name: "dependents straddling the cutoff",
+			packages: []Package{
+				{Name: "new", Date: ago(time.Hour)},
+				{Name: "old", Date: ago(3 * time.Hour)},
+				{Name: "at-cutoff", Date: ago(2 * time.Hour)},
+				{Name: "just-before-cutoff", Date: ago(2*time.Hour + time.Millisecond)},
+			},
+			wantRequests: map[string]int{"new": 1, "at-cutoff": 1},
+			wantLastRun:  true,
+		},
+		{
+			name: "scanner rejects the api key",
+			packages: []Package{
+				{Name: "a", Date: ago(time.Hour)},
+			},
+			respond:      func(string, int) int { return http.StatusUnauthorized },
+			wantRequests: map[string]int{"a": 1},
+			wantErr:      ErrUnauthorized,
+		},
+		{
+			name: "scanner fails once then succeeds",
+			packages: []Package{
+				{Name: "a", Date: ago(time.Hour)},
+				{Name: "b", Date: ago(time.Hour)},
+			},
+			respond: func(name string, n int) int {
+				if name == "a" && n == 1 {
+					return http.StatusInternalServerError
+				}
+				return http.StatusOK
+			},
+			wantRequests: map[string]int{"a": 2, "b": 1},
+			wantLastRun:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, tt.packages...)
+			h.scanner.respond = tt.respond
+			c := h.config(nil)
+
+			err := h.run(c)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("run returned %v, want %v", err, tt.wantErr)
+			}
+
+			submitted := h.scanner.submitted()
+			if len(submitted) != sumValues(tt.wantRequests) {
+				t.Errorf("scanner was sent %v, want %v", submitted, tt.wantRequests)
+			}
+			for name, want := range tt.wantRequests {
+				if got := h.scanner.count(name); got != want {
+					t.Errorf("%s sent %d times, want %d", name, got, want)
+				}
+				seen, err := c.Store.Has(Package{Name: name}, c.Scanners[0].Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if accepted := tt.wantErr == nil; seen != accepted {
+					t.Errorf("%s in store = %v, want %v", name, seen, accepted)
+				}
+			}
+
+			last, ok := c.State.LastRunFor("foo")
+			if ok != tt.wantLastRun {
+				t.Fatalf("last run recorded = %v, want %v", ok, tt.wantLastRun)
+			}
+			if ok && last != testNow.UnixMilli() {
+				t.Errorf("last run = %s, want %s", time.UnixMilli(last).UTC(), testNow)
+			}
+		})
+	}
+}
+
+func sumValues(m map[string]int) int {
+	n := 0
+	for _, v := range m {
+		n += v
+	}
+	return n
+}
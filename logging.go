@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+)
+
+// setupLogging installs the default slog logger for format, logging records
+// at level and above. "text" keeps the standard log package output; "json"
+// writes one JSON object per line for log aggregators. Output from the log
+// package is routed through the same logger.
+func setupLogging(format string, level slog.Level) {
+	if format == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+		return
+	}
+	slog.SetLogLoggerLevel(level)
+}
+
+// logErr logs msg at level with args, adding err, its class and, when err
+// came from an unexpected upstream response, its status code.
+func logErr(level slog.Level, msg string, err error, args ...any) {
+	args = append(args, "error", err)
+	if class := errorClass(err); class != "" {
+		args = append(args, "error_class", class)
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		args = append(args, "status_code", se.code)
+	}
+	slog.Log(context.Background(), level, msg, args...)
+}
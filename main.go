@@ -1,169 +1,2080 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"log/slog"
+	"math"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	cron "github.com/pardnchiu/go-cron"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 type Config struct {
-	ApiKey      string `json:"apikey"`
-	IntervalHrs string `json:"interval"`
-	Target      string `json:"target"`
-	Client      *http.Client
+	ApiKey     string `json:"apikey"`
+	ApiKeyFile string `json:"apikey_file"`
+	// AuthScheme is how the API key is sent to the scanner: "raw", as the
+	// authorization header by itself, or "bearer", as "Bearer <apikey>".
+	AuthScheme  string `json:"auth_scheme"`
+	IntervalHrs Hours  `json:"interval"`
+	Cron        string `json:"cron"`
+	// Minute is the minute of the hour targets without a cron expression run
+	// at. Unset, each target gets its own, derived from its name, so that
+	// targets spread out.
+	Minute *int    `json:"minute"`
+	Target Targets `json:"target"`
+	// PageSize is the number of dependents requested per page from
+	// ecosyste.ms. The npm browse endpoint takes no page size and always
+	// returns pages of 36, so for npm it is only a hint: paging advances by
+	// however many dependents each page held.
+	PageSize       int    `json:"page_size"`
+	StorePath      string `json:"store_path"`
+	StoreKind      string `json:"store"`
+	StateFile      string `json:"state_file"`
+	DeadLetterFile string `json:"dead_letter_file"`
+	DeadLetterMax  int    `json:"dead_letter_max"`
+	OutputFile     string `json:"output_file"`
+	OutputMaxBytes int64  `json:"output_max_bytes"`
+	DryRun         bool   `json:"dryrun"`
+	IncludeScoped  bool   `json:"include_scoped"`
+	ScanVersioned  bool   `json:"scan_versioned"`
+	ScannerURL     URLs   `json:"scanner_url"`
+	RegistryURL    string `json:"registry_url"`
+	// DependentsSource is where dependents are listed: "npm", the npmjs.com
+	// browse endpoint at RegistryURL, or "ecosystems", the ecosyste.ms
+	// packages API at EcosystemsURL.
+	DependentsSource string  `json:"dependents_source"`
+	EcosystemsURL    string  `json:"ecosystems_url"`
+	NPMRateLimit     float64 `json:"npm_rate_limit"`
+	Workers          int     `json:"workers"`
+	// BatchSize, if set, is the most packages sent to a scanner in a single
+	// request to its batch endpoint. Zero submits them one at a time.
+	BatchSize int `json:"batch_size"`
+	// MaxPerRun caps the packages submitted per run. The rest are left for
+	// the next run, which needs a store to skip those already sent.
+	MaxPerRun  int    `json:"max_per_run"`
+	Depth      int    `json:"depth"`
+	HealthPort int    `json:"health_port"`
+	APIToken   string `json:"api_token"`
+	RunHistory int    `json:"run_history"`
+	LogFormat  string `json:"log_format"`
+	// LogLevel is the least severe level logged: error, warn, info or
+	// debug. Each package sent or skipped is only logged at debug.
+	LogLevel          string     `json:"log_level"`
+	Level             slog.Level `json:"-"`
+	OTelEndpoint      string     `json:"otel_endpoint"`
+	HTTPTimeout       Duration   `json:"http_timeout"`
+	SlowScanThreshold Duration   `json:"slow_scan_threshold"`
+	ProxyURL          string     `json:"proxy_url"`
+	UserAgent         string     `json:"user_agent"`
+	Contact           string     `json:"contact"`
+	ShutdownGrace     Duration   `json:"shutdown_grace"`
+	ShutdownTimeout   Duration   `json:"shutdown_timeout"`
+	MinAge            Duration   `json:"min_age"`
+	Jitter            Duration   `json:"jitter"`
+	RunTimeout        Duration   `json:"run_timeout"`
+	ProgressInterval  Duration   `json:"progress_interval"`
+
+	// Each worker waits SubmitDelay, plus a random amount up to
+	// SubmitJitter, after every package it sends to the scanner, separately
+	// from npm_rate_limit. As the workers wait independently, the effective
+	// rate is at most workers / (submit_delay + submit_jitter/2 + response
+	// time) packages a second: raise the delay or lower workers to slow it.
+	SubmitDelay  Duration `json:"submit_delay"`
+	SubmitJitter Duration `json:"submit_jitter"`
+
+	// With TopN set, each run considers the first TopN dependents in the
+	// order the source lists them, whenever they were published, in place of
+	// those published since the last run. It cannot be combined with
+	// MinAge.
+	TopN int `json:"top_n"`
+
+	// Packages whose maintainers are all on MaintainerAllowlist are skipped.
+	// Packages with any maintainer on MaintainerDenylist are always
+	// submitted, whatever their publish date; the denylist wins when a
+	// package matches both.
+	MaintainerAllowlist []string `json:"maintainer_allowlist"`
+	MaintainerDenylist  []string `json:"maintainer_denylist"`
+
+	// Dependents within TyposquatDistance edits of a name in PopularPackages
+	// are submitted first, whatever their publish date.
+	PopularPackages   []string `json:"popular_packages"`
+	TyposquatDistance int      `json:"typosquat_distance"`
+
+	// Dependents whose description contains a KeywordWatchlist keyword,
+	// ignoring case, are logged as warnings and submitted first. With
+	// KeywordIgnoreCutoff they are also submitted whatever their publish
+	// date.
+	KeywordWatchlist    []string `json:"keyword_watchlist"`
+	KeywordIgnoreCutoff bool     `json:"keyword_ignore_cutoff"`
+
+	// Dependents whose names do not match NameIncludeRegex, or do match
+	// NameExcludeRegex, are skipped before any other check. Exclude takes
+	// precedence over include.
+	NameIncludeRegex string         `json:"name_include_regex"`
+	NameExcludeRegex string         `json:"name_exclude_regex"`
+	NameInclude      *regexp.Regexp `json:"-"`
+	NameExclude      *regexp.Regexp `json:"-"`
+
+	// Dependents listed in IgnoreFile, one name or pattern per line, are
+	// known to be good and never submitted. The file is read again when the
+	// config is reloaded.
+	IgnoreFile string   `json:"ignore_file"`
+	Ignore     []string `json:"-"`
+
+	// With MaxMaintainers set, dependents with more maintainers than it are
+	// skipped unless another rule forces them to be submitted, and those with
+	// a sole maintainer, typical of freshly created accounts, are submitted
+	// first. Zero means no limit.
+	MaxMaintainers int `json:"max_maintainers"`
+
+	// SeverityThreshold is the least severe verdict that is passed to
+	// Notifiers.
+	SeverityThreshold    string `json:"severity_threshold"`
+	NotifyNewMaintainers bool   `json:"notify_new_maintainers"`
+	SlackWebhookURL      string `json:"slack_webhook_url"`
+	DiscordWebhookURL    string `json:"discord_webhook_url"`
+	WebhookURL           string `json:"webhook_url"`
+	SummaryWebhookURL    string `json:"summary_webhook_url"`
+
+	// With PrioritiseByDownloads the weekly downloads of every candidate are
+	// looked up at DownloadsURL, and the least downloaded are submitted
+	// first. It costs an extra npm request per candidate.
+	PrioritiseByDownloads bool   `json:"prioritise_by_downloads"`
+	DownloadsURL          string `json:"downloads_url"`
+
+	// With ScanTarballs, packages a scanner responds 404 for are looked up
+	// in the registry at MetadataURL and their tarball, if no larger than
+	// MaxTarballBytes, is uploaded to the scanner instead.
+	ScanTarballs    bool   `json:"scan_tarballs"`
+	MetadataURL     string `json:"metadata_url"`
+	MaxTarballBytes int64  `json:"max_tarball_bytes"`
+
+	RetryAttempts  int      `json:"retry_attempts"`
+	RetryBaseDelay Duration `json:"retry_base_delay"`
+	RetryMaxDelay  Duration `json:"retry_max_delay"`
+	// RetryBudget caps the scanner retries of a run across all its packages,
+	// so that a degraded scanner cannot stretch every run by RetryAttempts
+	// for each package. Once it is spent, failed submissions go to the
+	// dead-letter file without being retried. 0 means no cap.
+	RetryBudget int `json:"retry_budget"`
+
+	// After BreakerFailures consecutive failed requests to a scanner, it is
+	// not sent anything for BreakerCooldown; submissions meant for it go to
+	// the dead-letter file.
+	BreakerFailures int      `json:"breaker_failures"`
+	BreakerCooldown Duration `json:"breaker_cooldown"`
+
+	// With AdaptiveBackoff, once BackoffAfter scheduled runs of a target
+	// have failed in a row, its interval doubles with every further failure,
+	// up to BackoffMax, until a run succeeds.
+	AdaptiveBackoff bool     `json:"adaptive_backoff"`
+	BackoffAfter    int      `json:"backoff_after"`
+	BackoffMax      Duration `json:"backoff_max"`
+
+	Client *http.Client `json:"-"`
+	Store  Store        `json:"-"`
+	State  *RunState    `json:"-"`
+
+	Scanners   []Scanner         `json:"-"`
+	Fetcher    DependentsFetcher `json:"-"`
+	Downloads  DownloadCounter   `json:"-"`
+	Clock      Clock             `json:"-"`
+	Notifiers  []Notifier        `json:"-"`
+	DeadLetter *DeadLetter       `json:"-"`
+	Output     *NDJSONFile       `json:"-"`
+
+	// Backfill ignores the cutoff so that every dependent is considered.
+	Backfill bool `json:"-"`
+}
+
+const (
+	defaultScannerURL    = "https://dprk-research.kmsec.uk/api/scanner/analyse/package/"
+	defaultRegistryURL   = "https://www.npmjs.com/browse/depended/"
+	defaultDownloadsURL  = "https://api.npmjs.org/downloads/point/last-week/"
+	defaultMetadataURL   = "https://registry.npmjs.org/"
+	defaultEcosystemsURL = "https://packages.ecosyste.ms/api/v1/registries/npmjs.org/packages/"
+	defaultUserAgent     = "dprk-hunter (dependencies)"
+)
+
+// maxDepth bounds depth: every level multiplies the number of npm requests a
+// run makes.
+const maxDepth = 5
+
+const defaultConfigPath = ".config"
+
+// defaultPageSize is the number of dependents npm returns per browse page.
+const defaultPageSize = 36
+
+// defaultWorkers is the number of concurrent scanner submissions.
+const defaultWorkers = 4
+
+const defaultHealthPort = 8080
+
+// defaultNPMRateLimit is the number of requests per second made to npm.
+const defaultNPMRateLimit = 1.0
+
+const defaultHTTPTimeout = Duration(5 * time.Second)
+
+// defaultShutdownGrace is how long in-flight scanner submissions may take to
+// finish after a shutdown signal before they are canceled.
+const defaultShutdownGrace = Duration(10 * time.Second)
+
+// defaultSlowScanThreshold is the scanner response time above which a
+// submission is logged as slow.
+const defaultSlowScanThreshold = Duration(2 * time.Second)
+
+// defaultProgressInterval is how often a run that is still paginating logs
+// its progress.
+const defaultProgressInterval = Duration(30 * time.Second)
+
+// defaultShutdownTimeout is how long runs may take to wind down once they
+// have been canceled before the process exits regardless.
+const defaultShutdownTimeout = Duration(30 * time.Second)
+
+const (
+	defaultRetryAttempts  = 3
+	defaultRetryBaseDelay = Duration(time.Second)
+	defaultRetryMaxDelay  = Duration(30 * time.Second)
+)
+
+// Duration is a time.Duration written in the config as a Go duration string,
+// e.g. "1m30s".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Hours is a whole, positive number of hours. In the config it may be given
+// as a number or, as older configs do, a string such as "2".
+type Hours int64
+
+func (h *Hours) UnmarshalJSON(b []byte) error {
+	var n int64
+	if err := json.Unmarshal(b, &n); err != nil {
+		var s string
+		if json.Unmarshal(b, &s) != nil {
+			return fmt.Errorf("interval must be a whole number of hours: %w", err)
+		}
+		n, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid interval %q: %w", s, err)
+		}
+	}
+	if n <= 0 {
+		return fmt.Errorf("interval must be a positive number of hours, got %d", n)
+	}
+	*h = Hours(n)
+	return nil
+}
+
+func (h Hours) Duration() time.Duration {
+	return time.Duration(h) * time.Hour
+}
+
+// URLs is a list of URLs. In the config it may be given as a single string or
+// an array of strings.
+type URLs []string
+
+func (u *URLs) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*u = URLs{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return fmt.Errorf("must be a string or an array of strings: %w", err)
+	}
+	*u = many
+	return nil
+}
+
+// Targets is the list of packages whose dependents are watched. In the config
+// it may be given as a single string or an array whose elements are package
+// names or Target objects.
+type Targets []Target
+
+func (t *Targets) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*t = Targets{{Name: single}}
+		return nil
+	}
+	var many []Target
+	if err := json.Unmarshal(b, &many); err != nil {
+		return fmt.Errorf("target must be a string or an array: %w", err)
+	}
+	*t = many
+	return nil
+}
+
+// Names returns the package names of the targets.
+func (t Targets) Names() []string {
+	names := make([]string, len(t))
+	for i, target := range t {
+		names[i] = target.Name
+	}
+	return names
+}
+
+// Target is a package whose dependents are watched. IntervalHrs and Cron
+// override the global interval and cron for this target only.
+type Target struct {
+	Name        string `json:"name"`
+	IntervalHrs Hours  `json:"interval,omitempty"`
+	Cron        string `json:"cron,omitempty"`
+	Minute      *int   `json:"minute,omitempty"`
+}
+
+// UnmarshalJSON accepts a bare package name as well as an object.
+func (t *Target) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*t = Target{Name: name}
+		return nil
+	}
+	type target Target
+	if err := json.Unmarshal(b, (*target)(t)); err != nil {
+		return fmt.Errorf("target must be a package name or an object: %w", err)
+	}
+	return nil
+}
+
+// schedule returns the cron expression the target's runs are scheduled with:
+// its cron expression if it has one, otherwise its minute of every interval
+// hours. The interval still sets how far back each run looks.
+func (t *Target) schedule() string {
+	if t.Cron != "" {
+		return t.Cron
+	}
+	minute := defaultMinute(t.Name)
+	if t.Minute != nil {
+		minute = *t.Minute
+	}
+	return fmt.Sprintf("%d */%d * * *", minute, t.IntervalHrs)
+}
+
+// defaultMinute derives a minute of the hour from name, so that targets
+// without a minute set do not all run at once.
+func defaultMinute(name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % 60)
+}
+
+// maxIntervalHrs bounds how far back a run may look.
+const maxIntervalHrs = 24 * 7
+
+// resolve fills in the target's schedule from the global interval, cron and
+// minute and validates it.
+func (t *Target) resolve(intervalHrs Hours, cron string, minute *int) error {
+	if t.IntervalHrs == 0 && t.Cron == "" {
+		t.Cron = cron
+	}
+	if t.Minute == nil {
+		t.Minute = minute
+	}
+	if t.Minute != nil && (*t.Minute < 0 || *t.Minute > 59) {
+		return fmt.Errorf("minute must be between 0 and 59, got %d", *t.Minute)
+	}
+	if t.IntervalHrs == 0 {
+		t.IntervalHrs = intervalHrs
+	}
+	if t.IntervalHrs == 0 {
+		return errors.New("interval not set")
+	}
+	// without a cron expression the interval is also the hour step of the
+	// schedule, which cannot be more than a day.
+	if t.Cron == "" && t.IntervalHrs > 24 {
+		return fmt.Errorf("interval must be at most 24 hours unless cron is set, got %d", t.IntervalHrs)
+	}
+	if t.IntervalHrs > maxIntervalHrs {
+		return fmt.Errorf("interval must be at most %d hours, got %d", maxIntervalHrs, t.IntervalHrs)
+	}
+	if t.Cron != "" {
+		if err := validateCron(t.Cron); err != nil {
+			return fmt.Errorf("invalid cron expression %q: %w", t.Cron, err)
+		}
+	}
+	return nil
 }
 
 type Package struct {
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	Maintainers []string `json:"maintainers"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Maintainers Maintainers `json:"maintainers"`
+
+	Publisher Publisher `json:"publisher"`
+	Date      Date      `json:"date"`
+	Version   string    `json:"version"`
+
+	// Downloads is the weekly download count. It is only looked up with
+	// prioritise_by_downloads set.
+	Downloads int64 `json:"downloads,omitempty"`
+}
+
+func (p *Package) IsScoped() bool {
+	return strings.HasPrefix(p.Name, "@")
+}
+
+// Publisher is the npm user who published a package. npm also sends their
+// avatars, which are left undecoded as nothing uses them.
+type Publisher struct {
+	Name string `json:"name"`
+}
+
+type Date struct {
+	TS  int64  `json:"ts"`
+	Rel string `json:"rel"`
+}
+
+// Maintainers is a list of maintainer names. npm gives maintainers either as
+// names or as objects with a name or username; both decode to names.
+type Maintainers []string
+
+func (m *Maintainers) UnmarshalJSON(b []byte) error {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("maintainers must be an array: %w", err)
+	}
+	names := make(Maintainers, 0, len(entries))
+	for _, e := range entries {
+		var name string
+		if err := json.Unmarshal(e, &name); err == nil {
+			names = append(names, name)
+			continue
+		}
+		var obj struct {
+			Name     string `json:"name"`
+			Username string `json:"username"`
+		}
+		if err := json.Unmarshal(e, &obj); err != nil {
+			return fmt.Errorf("maintainer must be a string or an object: %w", err)
+		}
+		name = obj.Name
+		if name == "" {
+			name = obj.Username
+		}
+		names = append(names, name)
+	}
+	*m = names
+	return nil
+}
+
+type Data struct {
+	Title      string    `json:"title"`
+	Dependency string    `json:"dependency"`
+	Packages   []Package `json:"packages"`
+	Total      int       `json:"total"`
+	// Malformed holds the errors for packages that could not be decoded,
+	// which decodeData leaves out of Packages rather than failing the whole
+	// page.
+	Malformed []error `json:"-"`
+}
+
+// Clock tells the time. It is replaced in tests to fix the cutoff.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// now returns the current time from c.Clock, defaulting to the real clock.
+func (c *Config) now() time.Time {
+	if c.Clock == nil {
+		return realClock{}.Now()
+	}
+	return c.Clock.Now()
+}
+
+// runStatus is the outcome of the most recent scheduled triage run.
+type runStatus struct {
+	mu          sync.Mutex
+	at          time.Time
+	lastSuccess time.Time
+	err         error
+}
+
+// lastRun is updated after every scheduled run so that a health check can
+// report on it.
+var lastRun runStatus
+
+func (s *runStatus) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.at = time.Now()
+	s.err = err
+	if err == nil {
+		s.lastSuccess = s.at
+	}
+}
+
+// get returns the time of the last run, the time of the last successful run
+// and the error of the last run. Zero times mean no such run has happened.
+func (s *runStatus) get() (at, lastSuccess time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.at, s.lastSuccess, s.err
+}
+
+// sendToScanner submits p to the scanner unless it has been sent before. It
+// reports whether the package was sent (or, in a dry run, would have been).
+func (c *Config) sendToScanner(ctx context.Context, target string, p Package, retries *retryBudget) (sent bool, err error) {
+	ctx, span := tracer.Start(ctx, "sendToScanner", trace.WithAttributes(
+		attribute.String("target", target),
+		attribute.String("package", p.Name),
+		attribute.String("version", p.Version),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Bool("sent", sent))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	key := seenKey(p)
+	// held from checking the store until the result is recorded in it
+	if !sending.acquire(key) {
+		slog.Debug("being sent by another run", "target", target, "package", key)
+		return false, nil
+	}
+	defer sending.release(key)
+	pending, err := c.pendingScanners(p)
+	if err != nil {
+		return false, err
+	}
+	if len(pending) == 0 {
+		slog.Debug("already sent to scanner", "target", target, "package", key)
+		return false, nil
+	}
+	if c.DryRun {
+		slog.Info("would send", "target", target, "package", p.Name)
+		return true, nil
+	}
+	if !submissions.start() {
+		return false, errShuttingDown
+	}
+	defer submissions.done()
+
+	// fan out to every scanner that has not accepted p yet. The submission
+	// succeeds if any of them accepts it; the rest are tried again on a
+	// later run.
+	var (
+		wg       sync.WaitGroup
+		results  = make([]*ScanResult, len(pending))
+		errs     = make([]error, len(pending))
+		accepted []string
+	)
+	for i, s := range pending {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = c.submit(ctx, s, target, p, retries)
+		}()
+	}
+	wg.Wait()
+	for i, s := range pending {
+		if errs[i] != nil {
+			if len(pending) > 1 {
+				logErr(slog.LevelError, "sending to scanner", errs[i], "target", target, "package", p.Name, "scanner", redactUserinfo(s.Name()))
+			}
+			continue
+		}
+		accepted = append(accepted, s.Name())
+	}
+	if len(accepted) == 0 {
+		return false, errors.Join(errs...)
+	}
+	result := mostSevere(results)
+	packagesTriaged.Inc()
+	verdicts.WithLabelValues(result.verdictLabel()).Inc()
+	c.forwardTriaged(target, p)
+	if err := c.Output.Write(triagedEvent{Target: target, Timestamp: time.Now().UTC(), Package: p}); err != nil {
+		slog.Error("writing to output file", "package", key, "error", err)
+	}
+	if result == nil {
+		slog.Debug("sent to scanner", "target", target, "package", p.Name)
+	} else {
+		// verdicts worth a notification are worth a log line too
+		level := slog.LevelDebug
+		if result.AtLeast(c.SeverityThreshold) {
+			level = slog.LevelInfo
+		}
+		slog.Log(ctx, level, "sent to scanner", "target", target, "package", p.Name,
+			"verdict", result.Verdict, "score", result.Score, "reasons", result.Reasons)
+		if result.AtLeast(c.SeverityThreshold) {
+			c.notify(Finding{Target: target, Package: p, Result: *result})
+		}
+	}
+	if err := c.Store.Add(p, target, accepted, result); err != nil {
+		slog.Error("recording package as sent", "package", key, "error", err)
+	}
+	return true, nil
+}
+
+// pendingScanners returns the scanners that have not accepted p yet.
+func (c *Config) pendingScanners(p Package) ([]Scanner, error) {
+	var pending []Scanner
+	for _, s := range c.Scanners {
+		seen, err := c.Store.Has(p, s.Name())
+		if err != nil {
+			return nil, err
+		}
+		if !seen {
+			pending = append(pending, s)
+		}
+	}
+	return pending, nil
+}
+
+// submit sends p to s, retrying with backoff up to c.RetryAttempts times while
+// retries lasts.
+func (c *Config) submit(ctx context.Context, s Scanner, target string, p Package, retries *retryBudget) (*ScanResult, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := s.Submit(ctx, c.scanName(p))
+		if err == nil {
+			return result, nil
+		}
+		var re *retryableError
+		if !errors.As(err, &re) || attempt >= c.RetryAttempts || ctx.Err() != nil || !retries.take(target) {
+			return nil, err
+		}
+		delay := re.after
+		if delay == 0 {
+			delay = c.retryDelay(attempt)
+		}
+		logErr(slog.LevelWarn, "scanner request failed, retrying", err, "target", target, "package", p.Name,
+			"scanner", redactUserinfo(s.Name()), "attempt", attempt, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryBudget is the number of scanner retries left in a run, shared by all
+// its submissions. A nil budget never runs out.
+type retryBudget struct {
+	size      int
+	left      atomic.Int64
+	exhausted atomic.Bool
+}
+
+// newRetryBudget returns a budget of n retries, or nil if n is 0.
+func newRetryBudget(n int) *retryBudget {
+	if n == 0 {
+		return nil
+	}
+	b := &retryBudget{size: n}
+	b.left.Store(int64(n))
+	return b
+}
+
+// take spends a retry and reports whether there was one left. It logs the
+// first time there is not.
+func (b *retryBudget) take(target string) bool {
+	if b == nil || b.left.Add(-1) >= 0 {
+		return true
+	}
+	if b.exhausted.CompareAndSwap(false, true) {
+		slog.Warn("retry budget exhausted, dead-lettering failed submissions without retrying", "target", target,
+			"retry_budget", b.size)
+	}
+	return false
+}
+
+// scanName returns what is submitted to the scanner for p: the package name,
+// or with ScanVersioned set, name@version so that the version that was
+// published is analysed rather than whatever is latest by then. Either is
+// escaped as a single path segment, so the scanner path for version 1.2.3 of
+// @scope/name is <scanner_url>%40scope%2Fname%401.2.3.
+func (c *Config) scanName(p Package) string {
+	if c.ScanVersioned && p.Version != "" {
+		return p.Name + "@" + p.Version
+	}
+	return p.Name
+}
+
+// retryDelay returns the exponential backoff delay before retry number
+// attempt, with jitter so that concurrent retries spread out.
+func (c *Config) retryDelay(attempt int) time.Duration {
+	delay := time.Duration(c.RetryBaseDelay) << (attempt - 1)
+	if delay <= 0 || delay > time.Duration(c.RetryMaxDelay) {
+		delay = time.Duration(c.RetryMaxDelay)
+	}
+	if delay < 2 {
+		return delay
+	}
+	return delay/2 + rand.N(delay/2)
+}
+
+// waitJitter delays a scheduled run of target by a random amount up to
+// c.Jitter, so that instances scheduled for the same minute do not all hit npm
+// at once. It returns false if ctx was canceled while waiting.
+func (c *Config) waitJitter(ctx context.Context, target string) bool {
+	if c.Jitter <= 0 {
+		return true
+	}
+	delay := rand.N(time.Duration(c.Jitter))
+	slog.Info("delaying scheduled run", "target", target, "jitter", delay, "start", time.Now().Add(delay).UTC())
+	select {
+	case <-time.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// waitSubmitDelay pauses a submission worker for c.SubmitDelay plus up to
+// c.SubmitJitter, or until ctx is canceled.
+func (c *Config) waitSubmitDelay(ctx context.Context) {
+	delay := time.Duration(c.SubmitDelay)
+	if c.SubmitJitter > 0 {
+		delay += rand.N(time.Duration(c.SubmitJitter))
+	}
+	if delay <= 0 || c.DryRun {
+		return
+	}
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an
+// HTTP date. It returns 0 if the header is missing or invalid.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// triageDependencies sends dependents of target published between cutoff and
+// until to the scanner and summarises what it did. The summary is returned even on error.
+func (c *Config) triageDependencies(ctx context.Context, target string, cutoff, until int64) (summary *RunSummary, err error) {
+	ctx, span := tracer.Start(ctx, "triageDependencies", trace.WithAttributes(attribute.String("target", target)))
+	summary = &RunSummary{Target: target, Start: time.Now().UTC()}
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "failure"
+			summary.Error = err.Error()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.SetAttributes(
+			attribute.Int("returned", summary.Returned),
+			attribute.Int("in_window", summary.InWindow),
+			attribute.Int("sent", summary.Sent),
+			attribute.Int("errored", summary.Errored),
+		)
+		span.End()
+		triageRuns.WithLabelValues(result).Inc()
+		lastRunTimestamp.SetToCurrentTime()
+		if err := c.Output.Flush(); err != nil {
+			slog.Error("flushing output file", "target", target, "error", err)
+		}
+		summary.End = time.Now().UTC()
+		summary.log()
+		lastSummaries.record(summary)
+		recentRuns.record(summary)
+		c.forwardSummary(summary)
+	}()
+	slog.Info("getting dependencies", "target", target)
+	var candidates, priority []Package
+	// a package can show up on more than one page if the listing shifts
+	// while we paginate; only submit it once per run.
+	queued := make(map[string]struct{})
+	// a run that failed part way through left a checkpoint: start at the
+	// page it could not fetch, then go back round to the pages before it.
+	// With top_n every run starts from the top.
+	start := c.State.CheckpointFor(target)
+	if c.TopN > 0 {
+		start = 0
+	}
+	if start > 0 {
+		slog.Info("resuming from checkpoint", "target", target, "offset", start)
+	}
+	// skip counts p as skipped for reason, the first filter it failed.
+	skip := func(p Package, reason string, args ...any) {
+		packagesSkipped.WithLabelValues(reason).Inc()
+		slog.Debug("skipping", append([]any{"target", target, "package", p.Name, "reason", reason}, args...)...)
+	}
+	// consider checks p against the filters and queues it for submission
+	// if it passes. Dependents are sorted by popularity rather than publish
+	// date, so every one has to be checked against the cutoff.
+	consider := func(p Package) {
+		// packages from denylisted maintainers are always submitted,
+		// whenever they were published.
+		denied := c.denylisted(p)
+		// so are likely typosquats of popular packages, ahead of
+		// everything else.
+		popular, distance, squat := c.typosquatOf(p.Name)
+		// and, optionally, those with watched keywords in their
+		// description.
+		keyword, watched := c.watchedKeyword(p)
+		// a missing timestamp decodes as 0, which would put p outside
+		// every window. It is estimated from the relative date if there
+		// is one, and otherwise p is submitted anyway: better a wasted
+		// scan than a fresh package never looked at.
+		undated := false
+		if p.Date.TS <= 0 {
+			if ts, ok := p.Date.estimate(c.now()); ok {
+				p.Date.TS = ts
+			} else {
+				slog.Warn("package has no publish timestamp, considering it anyway", "target", target,
+					"package", p.Name, "rel", p.Date.Rel)
+				undated = true
+			}
+		}
+		ignoreCutoff := denied || squat || undated || (watched && c.KeywordIgnoreCutoff)
+		// the cutoff is inclusive.
+		if p.Date.TS < cutoff && !ignoreCutoff {
+			skip(p, "too_old")
+			return
+		}
+		if _, ok := queued[p.Name]; ok {
+			return
+		}
+		queued[p.Name] = struct{}{}
+		if !c.nameMatches(p.Name) {
+			skip(p, "regex")
+			summary.NameFiltered++
+			return
+		}
+		if c.ignored(p.Name) {
+			skip(p, "ignored")
+			summary.Ignored++
+			return
+		}
+		if watched {
+			summary.Watched++
+		}
+		switch {
+		case squat:
+			summary.Typosquats++
+		case denied:
+			summary.Denylisted++
+		case watched && c.KeywordIgnoreCutoff:
+			// counted as watched above
+		default:
+			// too recent to scan yet: it may still be unpublished.
+			// It is picked up on a later run, since the last run is
+			// recorded as until rather than now. Nothing is recorded
+			// in the seen store for it: only packages a scanner
+			// accepted are, so it is submitted exactly once, once it
+			// has aged in.
+			if p.Date.TS > until {
+				skip(p, "too_new")
+				summary.TooNew++
+				return
+			}
+			summary.InWindow++
+			if p.IsScoped() && !c.IncludeScoped {
+				skip(p, "scoped")
+				summary.Scoped++
+				return
+			}
+			if c.allowlisted(p) {
+				skip(p, "allowlisted_maintainer")
+				summary.Allowlisted++
+				return
+			}
+			if c.MaxMaintainers > 0 && len(p.Maintainers) > c.MaxMaintainers {
+				skip(p, "too_many_maintainers", "maintainers", len(p.Maintainers), "max_maintainers", c.MaxMaintainers)
+				summary.TooManyMaintainers++
+				return
+			}
+		}
+		pending, err := c.pendingScanners(p)
+		if err != nil {
+			// sendToScanner checks again and reports the error
+			logErr(slog.LevelWarn, "checking seen store", err, "target", target, "package", seenKey(p))
+		}
+		if err == nil && len(pending) == 0 {
+			skip(p, "seen", "version", p.Version)
+			summary.AlreadySent++
+			return
+		}
+		if squat {
+			slog.Warn("possible typosquat", "target", target, "package", p.Name,
+				"popular", popular, "distance", distance)
+			priority = append(priority, p)
+			return
+		}
+		if watched {
+			slog.Warn("description matches keyword watchlist", "target", target, "package", p.Name,
+				"keyword", keyword, "description", p.Description)
+			priority = append(priority, p)
+			return
+		}
+		if c.MaxMaintainers > 0 && len(p.Maintainers) == 1 {
+			priority = append(priority, p)
+			return
+		}
+		candidates = append(candidates, p)
+	}
+	// with depth above 1, the packages to expand at the next level. Each is
+	// expanded once, which also stops cycles.
+	var level []string
+	visited := map[string]struct{}{target: {}}
+	var pageErr error
+	lastProgress := time.Now()
+	for offset, wrapped := start, start == 0; ; {
+		// on shutdown, save where paging got to so that the next run
+		// carries on from there
+		if ctx.Err() != nil {
+			slog.Info("run interrupted, saving checkpoint", "target", target, "offset", offset)
+			c.saveCheckpoint(target, offset)
+			pageErr = fmt.Errorf("interrupted at offset %d: %w", offset, ctx.Err())
+			break
+		}
+		packages, total, err := c.fetchDependents(ctx, target, offset)
+		if err != nil && ctx.Err() != nil {
+			// checkpointed at the top of the loop
+			continue
+		}
+		if err != nil {
+			logErr(slog.LevelError, "fetching dependents failed, saving checkpoint", err, "target", target, "offset", offset)
+			c.saveCheckpoint(target, offset)
+			pageErr = fmt.Errorf("fetching dependents at offset %d: %w", offset, err)
+			break
+		}
+		if len(packages) == 0 && offset == 0 {
+			// a new or niche package may have no dependents yet
+			slog.Info("target has no dependents", "target", target)
+			break
+		}
+		if c.TopN > 0 && summary.Returned+len(packages) > c.TopN {
+			packages = packages[:c.TopN-summary.Returned]
+		}
+		summary.Returned += len(packages)
+		for _, p := range packages {
+			c.checkMaintainers(target, p)
+			consider(p)
+			if c.Depth > 1 {
+				if _, ok := visited[p.Name]; !ok {
+					visited[p.Name] = struct{}{}
+					level = append(level, p.Name)
+				}
+			}
+		}
+		// long runs report how far they have got, backfills after every
+		// page.
+		if c.Backfill || time.Since(lastProgress) >= time.Duration(c.ProgressInterval) {
+			lastProgress = time.Now()
+			percent := 100
+			if total > 0 {
+				percent = min(100, summary.Returned*100/total)
+			}
+			slog.Info(fmt.Sprintf("triaged %d/%d dependents (%d%%)", summary.Returned, total, percent),
+				"target", target, "offset", offset, "candidates", len(priority)+len(candidates))
+		}
+		// advance by what the page held rather than page_size, which
+		// npm does not honour
+		offset += len(packages)
+		if c.TopN > 0 && summary.Returned >= c.TopN {
+			break
+		}
+		if len(packages) == 0 || offset >= total {
+			if wrapped {
+				break
+			}
+			offset, wrapped = 0, true
+		}
+		if wrapped && start > 0 && offset >= start {
+			break
+		}
+	}
+	// the dependents of dependents are considered a level at a time. A
+	// package that cannot be expanded is logged and skipped rather than
+	// failing the run.
+	for depth := 2; depth <= c.Depth && len(level) > 0; depth++ {
+		var next []string
+		for _, parent := range level {
+			if ctx.Err() != nil {
+				break
+			}
+			packages, err := c.allDependents(ctx, parent)
+			if err != nil {
+				logErr(slog.LevelWarn, "fetching transitive dependents", err, "target", target, "parent", parent, "depth", depth)
+			}
+			summary.Transitive += len(packages)
+			for _, p := range packages {
+				c.checkMaintainers(target, p)
+				consider(p)
+				if _, ok := visited[p.Name]; !ok {
+					visited[p.Name] = struct{}{}
+					next = append(next, p.Name)
+				}
+			}
+		}
+		level = next
+	}
+	// a dry run records nothing, and saving would still rewrite the store
+	if !c.DryRun {
+		if err := c.Store.Save(); err != nil {
+			slog.Error("recording maintainers", "target", target, "error", err)
+		}
+	}
+	if c.Downloads != nil {
+		c.sortByDownloads(ctx, target, candidates)
+	}
+	candidates = append(priority, candidates...)
+	if c.MaxPerRun > 0 && len(candidates) > c.MaxPerRun {
+		summary.Capped = len(candidates) - c.MaxPerRun
+		slog.Warn("max_per_run reached, leaving the rest for the next run", "target", target,
+			"max_per_run", c.MaxPerRun, "skipped", summary.Capped)
+		candidates = candidates[:c.MaxPerRun]
+	}
+	triaged, untried, errs := c.submitAll(ctx, target, candidates)
+	summary.Sent = triaged
+	summary.Errored = len(errs)
+	// a few failed submissions do not fail the run, so the cutoff still
+	// moves past them: they are logged and, if dead_letter_file is set,
+	// recorded there to be sent again with --retry-dead-letter. Only fail
+	// the run when the scanner rejected everything.
+	for _, err := range errs {
+		if errors.Is(err, ErrUnauthorized) {
+			return summary, err
+		}
+	}
+	if len(errs) > 0 && len(errs) == len(candidates) {
+		return summary, fmt.Errorf("all %d submissions to the scanner failed: %w", len(errs), errs[0])
+	}
+	// what was fetched before a page failed has been submitted, but the run
+	// still failed so that the cutoff is not moved past the rest.
+	if pageErr != nil {
+		return summary, pageErr
+	}
+	// likewise, on shutdown submitAll leaves candidates untried.
+	if untried > 0 {
+		return summary, fmt.Errorf("interrupted with %d packages left to submit: %w", untried, errShuttingDown)
+	}
+	if c.DryRun {
+		slog.Info("dry run: packages would have been sent to the scanner", "target", target, "count", triaged)
+		return summary, nil
+	}
+	if err := c.State.ClearCheckpoint(target); err != nil {
+		slog.Error("clearing checkpoint", "target", target, "error", err)
+	}
+	return summary, nil
+}
+
+// saveCheckpoint records offset as where the next run of target starts. A
+// dry run leaves the real bot's checkpoint alone.
+func (c *Config) saveCheckpoint(target string, offset int) {
+	if c.DryRun {
+		return
+	}
+	if err := c.State.SetCheckpoint(target, offset); err != nil {
+		slog.Error("saving checkpoint", "target", target, "error", err)
+	}
+}
+
+// allDependents fetches every page of dependents of name. On failure it
+// returns the dependents fetched so far along with the error.
+func (c *Config) allDependents(ctx context.Context, name string) ([]Package, error) {
+	var all []Package
+	for offset := 0; ; {
+		packages, total, err := c.fetchDependents(ctx, name, offset)
+		if err != nil {
+			return all, fmt.Errorf("fetching dependents of %s at offset %d: %w", name, offset, err)
+		}
+		all = append(all, packages...)
+		offset += len(packages)
+		if len(packages) == 0 || offset >= total {
+			return all, nil
+		}
+	}
+}
+
+// runTimeout returns how long a run of t may take: run_timeout if set,
+// otherwise half the target's interval. Backfills are not limited.
+func (c *Config) runTimeout(t Target) time.Duration {
+	switch {
+	case c.Backfill:
+		return 0
+	case c.RunTimeout > 0:
+		return time.Duration(c.RunTimeout)
+	default:
+		return t.IntervalHrs.Duration() / 2
+	}
+}
+
+// missedRuns returns the targets whose last successful run was more than an
+// interval ago, and so need a catch-up run when the process starts.
+// Targets that have never run are left to the scheduler.
+func (c *Config) missedRuns() Targets {
+	now := c.now()
+	var missed Targets
+	for _, t := range c.Target {
+		last, ok := c.State.LastRunFor(t.Name)
+		if !ok {
+			continue
+		}
+		from := time.UnixMilli(last).UTC()
+		if now.Sub(from) > t.IntervalHrs.Duration() {
+			slog.Info("performing catch-up run", "target", t.Name, "from", from, "to", now.UTC())
+			missed = append(missed, t)
+		}
+	}
+	return missed
+}
+
+// fetchDependents fetches a page of dependents, retrying with backoff up to
+// c.RetryAttempts times, or after as long as the fetcher was told to wait.
+func (c *Config) fetchDependents(ctx context.Context, target string, offset int) ([]Package, int, error) {
+	for attempt := 1; ; attempt++ {
+		packages, total, err := c.Fetcher.FetchDependents(ctx, target, offset)
+		// only outages and garbled responses are worth another try; a
+		// mismatched or missing target will not come right by itself.
+		transient := errors.Is(err, ErrUpstreamUnavailable) || errors.Is(err, ErrDecodeFailure)
+		if !transient || attempt >= c.RetryAttempts || ctx.Err() != nil {
+			return packages, total, err
+		}
+		delay := c.retryDelay(attempt)
+		var re *retryableError
+		if errors.As(err, &re) && re.after > 0 {
+			delay = re.after
+		}
+		logErr(slog.LevelWarn, "fetching dependents failed, retrying", err, "target", target, "offset", offset, "attempt", attempt, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+}
+
+// checkMaintainers records the maintainers of p and warns if any have been
+// added since p was last seen. A new maintainer on an established package is a
+// common sign of an account takeover, whatever the scanner makes of the code.
+// A dry run skips the check, as recording the maintainers would use up the
+// alert before the real bot sees them.
+func (c *Config) checkMaintainers(target string, p Package) {
+	if c.DryRun {
+		return
+	}
+	added, err := c.Store.UpdateMaintainers(p.Name, p.Maintainers)
+	if err != nil {
+		logErr(slog.LevelError, "recording maintainers", err, "target", target, "package", p.Name)
+		return
+	}
+	if len(added) == 0 {
+		return
+	}
+	slog.Warn("new maintainers on package", "target", target, "package", p.Name,
+		"added", added, "maintainers", p.Maintainers)
+	if c.NotifyNewMaintainers {
+		c.notify(Finding{Target: target, Package: p, NewMaintainers: added})
+	}
+}
+
+// allowlisted reports whether every maintainer of p is on the maintainer
+// allowlist. A package without maintainers is never allowlisted.
+func (c *Config) allowlisted(p Package) bool {
+	if len(p.Maintainers) == 0 {
+		return false
+	}
+	for _, m := range p.Maintainers {
+		if !slices.Contains(c.MaintainerAllowlist, m) {
+			return false
+		}
+	}
+	return true
+}
+
+// denylisted reports whether any maintainer of p is on the maintainer
+// denylist. This takes precedence over the allowlist, so a package with both
+// allowlisted and denylisted maintainers is submitted.
+func (c *Config) denylisted(p Package) bool {
+	for _, m := range p.Maintainers {
+		if slices.Contains(c.MaintainerDenylist, m) {
+			return true
+		}
+	}
+	return false
+}
 
-	Publisher Publisher `json:"publisher"`
-	Date      Date      `json:"date"`
-	Version   string    `json:"version"`
+// sortByDownloads looks up the weekly downloads of packages and sorts them
+// least downloaded first, since throwaway malware is rarely downloaded. A
+// package whose count cannot be looked up is treated as never downloaded.
+func (c *Config) sortByDownloads(ctx context.Context, target string, packages []Package) {
+	for i := range packages {
+		if ctx.Err() != nil {
+			return
+		}
+		n, err := c.Downloads.WeeklyDownloads(ctx, packages[i].Name)
+		if err != nil {
+			logErr(slog.LevelWarn, "looking up downloads", err, "target", target, "package", packages[i].Name)
+			continue
+		}
+		packages[i].Downloads = n
+	}
+	slices.SortStableFunc(packages, func(a, b Package) int {
+		return cmp.Compare(a.Downloads, b.Downloads)
+	})
 }
 
-func (p *Package) IsScoped() bool {
-	return strings.HasPrefix(p.Name, "@")
+// nameMatches reports whether name passes the include and exclude patterns.
+func (c *Config) nameMatches(name string) bool {
+	if c.NameExclude != nil && c.NameExclude.MatchString(name) {
+		return false
+	}
+	return c.NameInclude == nil || c.NameInclude.MatchString(name)
 }
 
-type Publisher struct {
-	Name    string                 `json:"name"`
-	Avatars map[string]interface{} `json:"avatars"`
+// watchedKeyword returns the first keyword on the watchlist that p's
+// description contains, ignoring case.
+func (c *Config) watchedKeyword(p Package) (string, bool) {
+	if len(c.KeywordWatchlist) == 0 {
+		return "", false
+	}
+	description := strings.ToLower(p.Description)
+	for _, k := range c.KeywordWatchlist {
+		if strings.Contains(description, k) {
+			return k, true
+		}
+	}
+	return "", false
 }
 
-type Date struct {
-	TS  int64  `json:"ts"`
-	Rel string `json:"rel"`
+// submitAll sends packages to the scanner using a pool of c.Workers
+// goroutines. It returns the number of packages sent, the number never tried
+// because the run was canceled or the process is shutting down, and any
+// errors.
+func (c *Config) submitAll(ctx context.Context, target string, packages []Package) (int, int, []error) {
+	var (
+		wg           sync.WaitGroup
+		mu           sync.Mutex
+		errs         []error
+		triaged      atomic.Int64
+		untried      atomic.Int64
+		unauthorized atomic.Bool
+		dispatched   int
+		retries      = newRetryBudget(c.RetryBudget)
+	)
+	jobs := make(chan Package)
+	// workers spend most of a batched submission waiting for the batch to
+	// fill, so there must be enough of them to fill one.
+	workers := max(c.Workers, c.BatchSize)
+	for range min(workers, len(packages)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				sent, err := c.sendToScanner(ctx, target, p, retries)
+				if errors.Is(err, ErrUnauthorized) && unauthorized.CompareAndSwap(false, true) {
+					slog.Error("scanner rejected the api key, abandoning the rest of the run", "target", target, "error", err)
+				}
+				if err != nil {
+					logErr(slog.LevelError, "sending to scanner", err, "target", target, "package", p.Name)
+					// packages skipped for shutdown were never tried
+					if errors.Is(err, errShuttingDown) || errors.Is(err, context.Canceled) {
+						untried.Add(1)
+					} else {
+						if err := c.DeadLetter.Add(target, p, err); err != nil {
+							slog.Error("recording dead-lettered package", "package", seenKey(p), "error", err)
+						}
+					}
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+					mu.Unlock()
+					continue
+				}
+				if sent {
+					triaged.Add(1)
+					c.waitSubmitDelay(ctx)
+				}
+			}
+		}()
+	}
+	for _, p := range packages {
+		if ctx.Err() != nil || submissions.stopped() || unauthorized.Load() {
+			break
+		}
+		jobs <- p
+		dispatched++
+	}
+	close(jobs)
+	wg.Wait()
+	return int(triaged.Load()), len(packages) - dispatched + int(untried.Load()), errs
 }
 
-type Data struct {
-	Title      string    `json:"title"`
-	Dependency string    `json:"dependency"`
-	Packages   []Package `json:"packages"`
+// runTriage triages each of targets once, covering the last interval hours of
+// each (or further back if an earlier run was missed). Targets that are
+// already being triaged are skipped.
+func (c *Config) runTriage(ctx context.Context, targets Targets) error {
+	now := c.now().UnixMilli()
+	until := now - time.Duration(c.MinAge).Milliseconds()
+	var errs []error
+	for _, t := range targets {
+		if err := c.runTarget(ctx, t, now, until); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func (c *Config) sendToScanner(packageName string) error {
-	req, err := http.NewRequest("GET", "https://dprk-research.kmsec.uk/api/scanner/analyse/package/"+packageName, nil)
-	if err != nil {
-		return fmt.Errorf("creating request for dependency %s: %w", packageName, err)
+// runTarget triages t once, as part of a run started at now.
+func (c *Config) runTarget(ctx context.Context, t Target, now, until int64) error {
+	target := t.Name
+	if !running.acquire(target) {
+		slog.Warn("previous run still in progress, skipping", "target", target)
+		return nil
+	}
+	// released even if the run panics, as the scheduler recovers panics and
+	// would otherwise leave the target blocked for good
+	defer running.release(target)
+
+	windowStart := now - t.IntervalHrs.Duration().Milliseconds()
+	// if the last successful run started before this window, the
+	// process was down or runs failed; widen the window to catch up.
+	cutoff := windowStart
+	if last, ok := c.State.LastRunFor(target); ok && last < cutoff {
+		cutoff = last
+	}
+	if c.Backfill {
+		cutoff = math.MinInt64
+	}
+	// the last run is still recorded as until, so that a switch back to
+	// the time window carries on from here.
+	windowEnd := until
+	if c.TopN > 0 {
+		cutoff, windowEnd = math.MinInt64, math.MaxInt64
+	}
+	slog.Info("starting triage", "target", target, "now", now, "cutoff", time.UnixMilli(cutoff).UTC())
+	runCtx, cancel := ctx, context.CancelFunc(func() {})
+	timeout := c.runTimeout(t)
+	if timeout > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	summary, err := c.triageDependencies(runCtx, target, cutoff, windowEnd)
+	if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		slog.Error("run exceeded deadline, in-flight requests canceled", "target", target, "timeout", timeout)
 	}
-	req.Header.Add("accept", "application/json")
-	req.Header.Add("authorization", c.ApiKey)
-	res, err := c.Client.Do(req)
 	if err != nil {
-		return fmt.Errorf("sending to scanner: %s: %w", packageName, err)
+		logErr(slog.LevelError, "triaging target", err, "target", target)
+		return err
 	}
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code %d from %s", res.StatusCode, res.Request.URL)
+	if summary.Capped > 0 {
+		// keep the old cutoff so the next run picks up what was left
+		return nil
 	}
-
-	if res.Request.URL.Path == "/login" {
-		return fmt.Errorf("api key is incorrect. bot was redirected to /login")
+	if c.DryRun {
+		// moving the cutoff would make the real bot skip this window
+		return nil
+	}
+	if err := c.State.SetLastRun(target, until); err != nil {
+		slog.Error("saving last run", "target", target, "error", err)
 	}
-	log.Printf("sent to scanner: %s", packageName)
 	return nil
 }
 
-func (c *Config) triageDependencies(cutoff int64) error {
-	log.Printf("getting dependencies for %s", c.Target)
-	req, err := http.NewRequest("GET", "https://www.npmjs.com/browse/depended/"+c.Target, nil)
-	if err != nil {
-		return fmt.Errorf("creating request for dependency %s: %w", c.Target, err)
+// running tracks the targets being triaged so that a scheduled run, a manual
+// run and catch-up never triage the same target at once.
+var running runGuard
+
+// sending tracks the package versions being submitted so that two targets
+// sharing a dependent, triaged at once, do not both submit it.
+var sending runGuard
+
+// runGuard is a set of keys, each held by at most one goroutine at a time.
+type runGuard struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+// acquire marks key as held. It returns false if it already was, in which
+// case release must not be called.
+func (g *runGuard) acquire(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.held[key] {
+		return false
+	}
+	if g.held == nil {
+		g.held = make(map[string]bool)
 	}
-	req.Header.Add("accept", "application/json")
-	req.Header.Add("x-spiferack", "1")
-	req.Header.Add("user-agent", "dprk-hunter (dependencies)")
-	res, err := c.Client.Do(req)
+	g.held[key] = true
+	return true
+}
+
+func (g *runGuard) release(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.held, key)
+}
+
+// validateCron checks that spec is accepted by the scheduler by adding it to,
+// and removing it from, a scheduler that is never started.
+func validateCron(spec string) error {
+	scheduler, err := cron.New(cron.Config{Location: time.UTC})
 	if err != nil {
-		return fmt.Errorf("doing request for %s: %w", req.URL, err)
+		return err
 	}
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code %d from %s", res.StatusCode, res.Request.URL)
+	id, err := scheduler.Add(spec, func() {})
+	if err != nil {
+		return err
 	}
-	var d Data
-	err = json.NewDecoder(res.Body).Decode(&d)
+	scheduler.Remove(id)
+	return nil
+}
+
+// validateProxyURL checks that u is an http(s) or SOCKS5 proxy URL.
+func validateProxyURL(u string) error {
+	parsed, err := url.Parse(u)
 	if err != nil {
-		return fmt.Errorf("decoding response from %s: %w", res.Request.URL, err)
+		return err
 	}
-	if d.Dependency != c.Target {
-		return fmt.Errorf("wanted dependency for %s, got %s", c.Target, d.Dependency)
+	switch parsed.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("%s is not an http(s) or socks5 URL", parsed.Redacted())
 	}
-	if len(d.Packages) == 0 {
-		return fmt.Errorf("returned 0 dependencies for %s", c.Target)
+	if parsed.Host == "" {
+		return fmt.Errorf("%s has no host", parsed.Redacted())
 	}
-	triaged := 0
-	for _, p := range d.Packages {
-		if p.Date.TS < cutoff {
-			break
-		}
-		if p.IsScoped() {
-			continue
-		}
-		err = c.sendToScanner(p.Name)
-		if err != nil {
-			return err
-		}
-		triaged++
+	return nil
+}
 
+// validateURL checks that u is an absolute http(s) URL.
+func validateURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("%s is not an http(s) URL", parsed.Redacted())
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("%s has no host", parsed.Redacted())
 	}
 	return nil
 }
 
-func LoadConfig() (*Config, error) {
-	var configPath = ".config"
-
-	if isDocker := os.Getenv("DOCKER"); isDocker != "" {
-		configPath = "/var/run/secrets/.config"
+// normaliseBaseURL checks that u is an absolute http(s) URL and ensures it ends
+// in a slash, so that a path segment can be appended to it.
+func normaliseBaseURL(u string) (string, error) {
+	if err := validateURL(u); err != nil {
+		return "", err
 	}
-	b, err := os.ReadFile(configPath)
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	return u, nil
+}
 
+func LoadConfig(configPath, format string) (*Config, error) {
+	if configPath == "" {
+		configPath = defaultConfigPath
+		if isDocker := os.Getenv("DOCKER"); isDocker != "" {
+			configPath = "/var/run/secrets/.config"
+		}
+	}
+	format, err := configFormat(configPath, format)
 	if err != nil {
-		return nil, fmt.Errorf("reading config: %w", err)
+		return nil, err
 	}
 	var config Config
-	err = json.Unmarshal(b, &config)
-	if err != nil {
-		return nil, fmt.Errorf("unmarshalling config: %w", err)
+	b, err := os.ReadFile(configPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && hasEnvConfig():
+		// configured entirely through the environment
+	case err != nil:
+		return nil, fmt.Errorf("reading config: %w", err)
+	default:
+		err = decodeConfig(b, format, &config)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshalling %s config %s: %w", format, configPath, err)
+		}
+	}
+	if err := config.applyEnv(); err != nil {
+		return nil, fmt.Errorf("reading config from environment: %w", err)
+	}
+	if config.ApiKeyFile != "" {
+		if config.ApiKey != "" {
+			return nil, errors.New("only one of apikey and apikey_file may be set")
+		}
+		key, err := os.ReadFile(config.ApiKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading apikey_file: %w", err)
+		}
+		config.ApiKey = strings.TrimSpace(string(key))
 	}
 	if config.ApiKey == "" {
 		return nil, errors.New("apikey not set")
 	}
-	if config.IntervalHrs == "" {
-		return nil, errors.New("interval not set")
+	switch config.AuthScheme {
+	case "":
+		config.AuthScheme = "raw"
+	case "raw", "bearer":
+	default:
+		return nil, fmt.Errorf("auth_scheme must be raw or bearer, got %q", config.AuthScheme)
+	}
+	switch config.StoreKind {
+	case "":
+		config.StoreKind = "json"
+	case "json", "sqlite":
+	default:
+		return nil, fmt.Errorf("store must be json or sqlite, got %q", config.StoreKind)
+	}
+	if config.PageSize < 0 {
+		return nil, errors.New("page_size must be positive")
+	}
+	if config.PageSize == 0 {
+		config.PageSize = defaultPageSize
+	}
+	if config.Workers < 0 {
+		return nil, errors.New("workers must be positive")
+	}
+	if config.Workers == 0 {
+		config.Workers = defaultWorkers
+	}
+	if config.BatchSize < 0 {
+		return nil, errors.New("batch_size must be positive")
+	}
+	switch config.LogFormat {
+	case "":
+		config.LogFormat = "text"
+	case "text", "json":
+	default:
+		return nil, fmt.Errorf("log_format must be text or json, got %q", config.LogFormat)
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+	if err := config.Level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		return nil, fmt.Errorf("log_level must be error, warn, info or debug, got %q", config.LogLevel)
+	}
+	if config.SeverityThreshold == "" {
+		config.SeverityThreshold = defaultSeverityThreshold
+	}
+	if _, ok := severities[config.SeverityThreshold]; !ok {
+		return nil, fmt.Errorf("severity_threshold must be benign, suspicious or malicious, got %q", config.SeverityThreshold)
+	}
+	if config.SlackWebhookURL != "" {
+		if err := validateURL(config.SlackWebhookURL); err != nil {
+			return nil, fmt.Errorf("slack_webhook_url: %w", err)
+		}
+	}
+	if config.DiscordWebhookURL != "" {
+		if err := validateURL(config.DiscordWebhookURL); err != nil {
+			return nil, fmt.Errorf("discord_webhook_url: %w", err)
+		}
+	}
+	if config.WebhookURL != "" {
+		if err := validateURL(config.WebhookURL); err != nil {
+			return nil, fmt.Errorf("webhook_url: %w", err)
+		}
+	}
+	if config.MaxPerRun < 0 {
+		return nil, errors.New("max_per_run must be positive")
+	}
+	// a capped run keeps its cutoff so that the next run picks up what was
+	// left, which only gets further if the store remembers what was sent;
+	// without one every run would submit the same max_per_run packages.
+	if config.MaxPerRun > 0 && config.StorePath == "" {
+		return nil, errors.New("max_per_run needs store_path to be set")
+	}
+	if config.SummaryWebhookURL != "" {
+		if err := validateURL(config.SummaryWebhookURL); err != nil {
+			return nil, fmt.Errorf("summary_webhook_url: %w", err)
+		}
+	}
+	if config.OTelEndpoint != "" {
+		if err := validateURL(config.OTelEndpoint); err != nil {
+			return nil, fmt.Errorf("otel_endpoint: %w", err)
+		}
+	}
+	if config.ProxyURL != "" {
+		if err := validateProxyURL(config.ProxyURL); err != nil {
+			return nil, fmt.Errorf("proxy_url: %w", err)
+		}
+	}
+	if config.NPMRateLimit < 0 {
+		return nil, errors.New("npm_rate_limit must be positive")
+	}
+	if config.NPMRateLimit == 0 {
+		config.NPMRateLimit = defaultNPMRateLimit
+	}
+	if config.TyposquatDistance < 0 {
+		return nil, errors.New("typosquat_distance must be positive")
+	}
+	if config.TyposquatDistance == 0 {
+		config.TyposquatDistance = defaultTyposquatDistance
+	}
+	if config.NameIncludeRegex != "" {
+		if config.NameInclude, err = regexp.Compile(config.NameIncludeRegex); err != nil {
+			return nil, fmt.Errorf("name_include_regex: %w", err)
+		}
+	}
+	if config.NameExcludeRegex != "" {
+		if config.NameExclude, err = regexp.Compile(config.NameExcludeRegex); err != nil {
+			return nil, fmt.Errorf("name_exclude_regex: %w", err)
+		}
+	}
+	if config.IgnoreFile != "" {
+		if config.Ignore, err = loadIgnoreFile(config.IgnoreFile); err != nil {
+			return nil, err
+		}
+	}
+	if config.MaxMaintainers < 0 {
+		return nil, errors.New("max_maintainers must be positive")
+	}
+	for i, k := range config.KeywordWatchlist {
+		// an empty keyword would match every package
+		if strings.TrimSpace(k) == "" {
+			return nil, errors.New("keyword_watchlist must not contain empty keywords")
+		}
+		config.KeywordWatchlist[i] = strings.ToLower(k)
+	}
+	if config.Depth < 0 {
+		return nil, errors.New("depth must be positive")
+	}
+	if config.Depth == 0 {
+		config.Depth = 1
+	}
+	if config.Depth > maxDepth {
+		return nil, fmt.Errorf("depth must be at most %d, got %d", maxDepth, config.Depth)
+	}
+	if config.RunHistory < 0 {
+		return nil, errors.New("run_history must be positive")
+	}
+	if config.RunHistory == 0 {
+		config.RunHistory = defaultRunHistory
+	}
+	if config.OutputMaxBytes < 0 {
+		return nil, errors.New("output_max_bytes must be positive")
+	}
+	if config.DeadLetterMax < 0 {
+		return nil, errors.New("dead_letter_max must be positive")
+	}
+	if config.DeadLetterMax == 0 {
+		config.DeadLetterMax = defaultDeadLetterMax
+	}
+	if config.SlowScanThreshold < 0 {
+		return nil, errors.New("slow_scan_threshold must be positive")
+	}
+	if config.SlowScanThreshold == 0 {
+		config.SlowScanThreshold = defaultSlowScanThreshold
 	}
-	if config.Target == "" {
+	if config.ProgressInterval < 0 {
+		return nil, errors.New("progress_interval must be positive")
+	}
+	if config.ProgressInterval == 0 {
+		config.ProgressInterval = defaultProgressInterval
+	}
+	if config.RunTimeout < 0 {
+		return nil, errors.New("run_timeout must be positive")
+	}
+	if config.Jitter < 0 {
+		return nil, errors.New("jitter must be positive")
+	}
+	if config.MinAge < 0 {
+		return nil, errors.New("min_age must be positive")
+	}
+	if config.SubmitDelay < 0 {
+		return nil, errors.New("submit_delay must be positive")
+	}
+	if config.SubmitJitter < 0 {
+		return nil, errors.New("submit_jitter must be positive")
+	}
+	if config.TopN < 0 {
+		return nil, errors.New("top_n must be positive")
+	}
+	if config.TopN > 0 && config.MinAge > 0 {
+		return nil, errors.New("top_n and min_age are mutually exclusive")
+	}
+	if config.HealthPort < 0 || config.HealthPort > 65535 {
+		return nil, errors.New("health_port must be a valid port number")
+	}
+	if config.HealthPort == 0 {
+		config.HealthPort = defaultHealthPort
+	}
+	if config.HTTPTimeout < 0 {
+		return nil, errors.New("http_timeout must be positive")
+	}
+	if config.HTTPTimeout == 0 {
+		config.HTTPTimeout = defaultHTTPTimeout
+	}
+	if config.ShutdownGrace < 0 {
+		return nil, errors.New("shutdown_grace must be positive")
+	}
+	if config.ShutdownGrace == 0 {
+		config.ShutdownGrace = defaultShutdownGrace
+	}
+	if config.ShutdownTimeout < 0 {
+		return nil, errors.New("shutdown_timeout must be positive")
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if config.BreakerFailures < 0 {
+		return nil, errors.New("breaker_failures must be positive")
+	}
+	if config.BreakerFailures == 0 {
+		config.BreakerFailures = defaultBreakerFailures
+	}
+	if config.BreakerCooldown < 0 {
+		return nil, errors.New("breaker_cooldown must be positive")
+	}
+	if config.BreakerCooldown == 0 {
+		config.BreakerCooldown = defaultBreakerCooldown
+	}
+	if config.BackoffAfter < 0 {
+		return nil, errors.New("backoff_after must be positive")
+	}
+	if config.BackoffAfter == 0 {
+		config.BackoffAfter = defaultBackoffAfter
+	}
+	if config.BackoffMax < 0 {
+		return nil, errors.New("backoff_max must be positive")
+	}
+	if config.BackoffMax == 0 {
+		config.BackoffMax = defaultBackoffMax
+	}
+	if config.RetryAttempts < 0 {
+		return nil, errors.New("retry_attempts must be positive")
+	}
+	if config.RetryAttempts == 0 {
+		config.RetryAttempts = defaultRetryAttempts
+	}
+	if config.RetryBudget < 0 {
+		return nil, errors.New("retry_budget must be positive")
+	}
+	if config.RetryBaseDelay <= 0 {
+		config.RetryBaseDelay = defaultRetryBaseDelay
+	}
+	if config.RetryMaxDelay <= 0 {
+		config.RetryMaxDelay = defaultRetryMaxDelay
+	}
+	if len(config.ScannerURL) == 0 {
+		config.ScannerURL = URLs{defaultScannerURL}
+	}
+	for i, u := range config.ScannerURL {
+		config.ScannerURL[i], err = normaliseBaseURL(u)
+		if err != nil {
+			return nil, fmt.Errorf("scanner_url: %w", err)
+		}
+	}
+	if config.RegistryURL == "" {
+		config.RegistryURL = defaultRegistryURL
+	}
+	config.RegistryURL, err = normaliseBaseURL(config.RegistryURL)
+	if err != nil {
+		return nil, fmt.Errorf("registry_url: %w", err)
+	}
+	switch config.DependentsSource {
+	case "":
+		config.DependentsSource = "npm"
+	case "npm", "ecosystems":
+	default:
+		return nil, fmt.Errorf("dependents_source must be npm or ecosystems, got %q", config.DependentsSource)
+	}
+	if config.EcosystemsURL == "" {
+		config.EcosystemsURL = defaultEcosystemsURL
+	}
+	config.EcosystemsURL, err = normaliseBaseURL(config.EcosystemsURL)
+	if err != nil {
+		return nil, fmt.Errorf("ecosystems_url: %w", err)
+	}
+	if config.DownloadsURL == "" {
+		config.DownloadsURL = defaultDownloadsURL
+	}
+	config.DownloadsURL, err = normaliseBaseURL(config.DownloadsURL)
+	if err != nil {
+		return nil, fmt.Errorf("downloads_url: %w", err)
+	}
+	if config.MetadataURL == "" {
+		config.MetadataURL = defaultMetadataURL
+	}
+	config.MetadataURL, err = normaliseBaseURL(config.MetadataURL)
+	if err != nil {
+		return nil, fmt.Errorf("metadata_url: %w", err)
+	}
+	if config.MaxTarballBytes < 0 {
+		return nil, errors.New("max_tarball_bytes must be positive")
+	}
+	if config.MaxTarballBytes == 0 {
+		config.MaxTarballBytes = defaultMaxTarballBytes
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = defaultUserAgent
+	}
+	if config.Contact != "" {
+		config.UserAgent += " (+" + config.Contact + ")"
+	}
+	if len(config.Target) == 0 {
 		return nil, errors.New("target not set")
 	}
+	for i := range config.Target {
+		t := &config.Target[i]
+		if t.Name == "" {
+			return nil, errors.New("target contains an empty package name")
+		}
+		if err := t.resolve(config.IntervalHrs, config.Cron, config.Minute); err != nil {
+			return nil, fmt.Errorf("target %s: %w", t.Name, err)
+		}
+	}
 	return &config, nil
 }
 func main() {
+	once := flag.Bool("once", false, "run a single triage pass and exit instead of starting the scheduler")
+	dryRun := flag.Bool("dry-run", false, "log which packages would be sent without contacting the scanner")
+	retryDeadLetter := flag.Bool("retry-dead-letter", false, "send the packages in the dead-letter file to the scanner again and exit")
+	healthcheck := flag.Bool("healthcheck", false, "probe the running bot's /healthz endpoint and exit 0 if it is healthy, 1 otherwise")
+	backfill := flag.Bool("backfill", false, "run a single pass over every dependent, whenever published, and exit")
+	configPath := flag.String("config", "", "path to the config file (default "+defaultConfigPath+", or /var/run/secrets/.config with DOCKER set)")
+	format := flag.String("config-format", "", "format of the config file: json, yaml or toml (default from the file extension, otherwise json)")
+	logLevel := flag.String("log-level", "", "least severe level to log: error, warn, info or debug (default from log_level, otherwise info)")
+	checkConfig := flag.Bool("check-config", false, "validate the config, print it with secrets redacted and exit")
+	printSchedule := flag.Bool("print-schedule", false, "print each target's cron expression and its next few runs and exit")
+	flag.Parse()
+
 	quitChannel := make(chan os.Signal, 1)
 	signal.Notify(quitChannel, syscall.SIGINT, syscall.SIGTERM)
 
 	// initialise config
-	config, err := LoadConfig()
+	config, err := LoadConfig(*configPath, *format)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *checkConfig {
+		if err := config.checkConfig(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *printSchedule {
+		if err := config.printSchedule(os.Stdout, time.Now()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *healthcheck {
+		os.Exit(runHealthcheck(config.HealthPort))
+	}
+	if *logLevel != "" {
+		if err := config.Level.UnmarshalText([]byte(*logLevel)); err != nil {
+			log.Fatalf("--log-level must be error, warn, info or debug, got %q", *logLevel)
+		}
+	}
+	setupLogging(config.LogFormat, config.Level)
+	recentRuns.setSize(config.RunHistory)
+	if *dryRun {
+		config.DryRun = true
+	}
+	if config.DryRun {
+		slog.Info("dry run: packages will not be sent to the scanner")
+	}
+	if *backfill {
+		if config.TopN > 0 {
+			log.Fatal("--backfill cannot be used with top_n")
+		}
+		config.Backfill = true
+		*once = true
+		slog.Info("backfill: every dependent will be considered")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.ProxyURL != "" {
+		// validated by LoadConfig
+		proxy, _ := url.Parse(config.ProxyURL)
+		transport.Proxy = http.ProxyURL(proxy)
+		slog.Info("using proxy", "proxy", proxy.Redacted())
+	}
+	if config.OTelEndpoint != "" {
+		shutdownTracing, err := setupTracing(context.Background(), config.OTelEndpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(ctx); err != nil {
+				slog.Error("flushing traces", "error", err)
+			}
+		}()
+	}
 	config.Client = &http.Client{
-		Timeout: 5 * time.Second,
+		Timeout:   time.Duration(config.HTTPTimeout),
+		Transport: transport,
+		// redirects are returned to the caller rather than followed, so
+		// that a redirect to the scanner's login page or away from npm is
+		// never mistaken for a successful response.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if config.SlackWebhookURL != "" {
+		config.Notifiers = append(config.Notifiers, &SlackNotifier{URL: config.SlackWebhookURL, Client: config.Client})
+	}
+	if config.DiscordWebhookURL != "" {
+		config.Notifiers = append(config.Notifiers, &DiscordNotifier{URL: config.DiscordWebhookURL, Client: config.Client})
+	}
+	fetcher := &NPMFetcher{
+		BaseURL:         config.RegistryURL,
+		DownloadsURL:    config.DownloadsURL,
+		MetadataURL:     config.MetadataURL,
+		MaxTarballBytes: config.MaxTarballBytes,
+		Client:          config.Client,
+		UserAgent:       config.UserAgent,
+		Limiter:         rate.NewLimiter(rate.Limit(config.NPMRateLimit), 1),
+	}
+	config.Fetcher = fetcher
+	if config.DependentsSource == "ecosystems" {
+		config.Fetcher = &EcosystemsFetcher{
+			BaseURL:   config.EcosystemsURL,
+			PageSize:  config.PageSize,
+			Client:    config.Client,
+			UserAgent: config.UserAgent,
+			Limiter:   fetcher.Limiter,
+		}
+	}
+	if config.PrioritiseByDownloads {
+		config.Downloads = fetcher
+	}
+	for _, u := range config.ScannerURL {
+		scanner := &HTTPScanner{
+			BaseURL:       u,
+			ApiKey:        config.ApiKey,
+			AuthScheme:    config.AuthScheme,
+			UserAgent:     config.UserAgent,
+			Client:        config.Client,
+			SlowThreshold: time.Duration(config.SlowScanThreshold),
+		}
+		if !config.DryRun {
+			// only a rejected key is worth refusing to start for; a
+			// scanner that is briefly down, say mid-deploy, is retried
+			// by runs as usual
+			err := scanner.Ping(context.Background())
+			if errors.Is(err, ErrUnauthorized) {
+				log.Fatal(err)
+			}
+			if err != nil {
+				logErr(slog.LevelWarn, "could not reach scanner to check the api key, starting anyway", err, "scanner", u)
+			}
+		}
+		var s Scanner = scanner
+		if config.BatchSize > 0 {
+			s = newBatchScanner(scanner, scanner, config.BatchSize)
+		}
+		if config.ScanTarballs {
+			s = &tarballScanner{Scanner: s, fetcher: fetcher, upload: scanner}
+		}
+		config.Scanners = append(config.Scanners,
+			newBreakerScanner(s, config.BreakerFailures, time.Duration(config.BreakerCooldown)))
 	}
-	log.Printf("initialised with dependency target `%s`", config.Target)
-	interval, err := strconv.ParseInt(config.IntervalHrs, 10, 64)
+	config.Store, err = OpenStore(config.StoreKind, config.StorePath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer config.Store.Close()
+	if config.StorePath != "" {
+		slog.Info("loaded previously sent packages", "count", config.Store.Len(), "store", config.StoreKind, "path", config.StorePath)
+	}
+	if config.StateFile != "" {
+		config.State, err = LoadRunState(config.StateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.DeadLetterFile != "" {
+		config.DeadLetter, err = LoadDeadLetter(config.DeadLetterFile, config.DeadLetterMax)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.OutputFile != "" {
+		config.Output, err = OpenNDJSONFile(config.OutputFile, config.OutputMaxBytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer config.Output.Close()
+	}
+	slog.Info("initialised with dependency targets", "targets", config.Target.Names())
+
+	if *retryDeadLetter {
+		if config.DeadLetter == nil {
+			log.Fatal("--retry-dead-letter needs dead_letter_file to be set")
+		}
+		err := config.retryDeadLetter(context.Background())
+		pendingWebhooks.Wait()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *once {
+		// on SIGINT or SIGTERM, stop and save where paging got to
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-quitChannel
+			slog.Info("shutting down")
+			cancel()
+		}()
+		err := config.runTriage(ctx, config.Target)
+		pendingWebhooks.Wait()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	// Initialize (optional configuration)
 	scheduler, err := cron.New(cron.Config{
@@ -174,24 +2085,90 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// the health server runs for the life of the process, independently of
+	// the scheduler: it is up before the catch-up run, is left alone when
+	// SIGHUP reschedules the targets and is shut down last. /healthz reports
+	// 503 until the scheduler has started.
+	health := config.newHealthServer()
+	go func() {
+		if err := health.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	slog.Info("health check listening", "addr", health.Addr)
+
+	// runs are canceled once the shutdown grace period has passed
+	runCtx, cancelRuns := context.WithCancel(context.Background())
+	defer cancelRuns()
+
+	// the scheduler does not fire runs missed while the process was down
+	paused.Store(config.State.IsPaused())
+	if paused.Load() {
+		slog.Info("scheduled runs are paused; resume them with POST /api/resume")
+	}
+	var missed Targets
+	if !paused.Load() {
+		missed = config.missedRuns()
+	}
+
 	// Start scheduler
 	scheduler.Start()
+	schedulerRunning.Store(true)
 
-	// Add tasks
-	_, err = scheduler.Add(fmt.Sprintf("52 */%s * * *", config.IntervalHrs), func() {
-		now := time.Now().UnixMilli()
-		cutoff := now - time.Hour.Milliseconds()*interval
-		as_time := time.UnixMilli(cutoff).UTC()
-		log.Printf("now: %d cutoff: %s", now, as_time)
-		err := config.triageDependencies(cutoff)
-		if err != nil {
-			log.Fatal(err)
+	// Add tasks, one per target so that each keeps its own schedule. They
+	// are replaced when the config is reloaded; runs already started carry
+	// on with the config they were scheduled with.
+	var current atomic.Pointer[Config]
+	current.Store(config)
+	var tasks []int64
+	scheduleTargets := func(c *Config) error {
+		for _, id := range tasks {
+			scheduler.Remove(id)
 		}
-	}, "hunt for dependencies")
-
-	if err != nil {
+		tasks = nil
+		for _, t := range c.Target {
+			id, err := scheduler.Add(t.schedule(), func() {
+				if paused.Load() {
+					slog.Info("paused, skipping scheduled run", "target", t.Name)
+					return
+				}
+				start := c.now()
+				if c.AdaptiveBackoff && !runBackoff.due(t.Name, start) {
+					slog.Info("backing off after failed runs, skipping scheduled run", "target", t.Name)
+					return
+				}
+				if !c.waitJitter(runCtx, t.Name) {
+					return
+				}
+				err := c.runTriage(runCtx, Targets{t})
+				lastRun.record(err)
+				if c.AdaptiveBackoff {
+					c.recordBackoff(t, start, err)
+				}
+			}, "hunt for dependencies of "+t.Name)
+			if err != nil {
+				return err
+			}
+			tasks = append(tasks, id)
+			slog.Info("scheduled target", "target", t.Name, "schedule", t.schedule(), "interval", t.IntervalHrs)
+		}
+		return nil
+	}
+	if err := scheduleTargets(config); err != nil {
 		log.Fatal(err)
 	}
+	// the catch-up run can take as long as a run timeout, so it runs
+	// alongside the scheduler rather than ahead of it: signals and health
+	// checks are served meanwhile, and a scheduled run of a target being
+	// caught up is skipped by the run guard.
+	var catchingUp sync.WaitGroup
+	if len(missed) > 0 {
+		catchingUp.Add(1)
+		go func() {
+			defer catchingUp.Done()
+			lastRun.record(config.runTriage(runCtx, missed))
+		}()
+	}
 	// View task list
 	// tasks := scheduler.List()
 	// fmt.Printf("Currently have %d tasks\n", len(tasks))
@@ -201,9 +2178,82 @@ func main() {
 
 	// // Remove all tasks
 	// scheduler.RemoveAll()
+	manualRun := make(chan os.Signal, 1)
+	signal.Notify(manualRun, syscall.SIGUSR1)
+	var manualRunning atomic.Bool
+	go func() {
+		for range manualRun {
+			if !manualRunning.CompareAndSwap(false, true) {
+				slog.Warn("manual run requested but one is already in progress")
+				continue
+			}
+			slog.Info("manual run requested")
+			go func() {
+				defer manualRunning.Store(false)
+				c := current.Load()
+				lastRun.record(c.runTriage(runCtx, c.Target))
+			}()
+		}
+	}()
+
+	// SIGHUP reloads the config. An invalid config is logged and the old
+	// one kept. Only the scheduled tasks are replaced, so scrapes of the
+	// health server carry on throughout. To check by hand, run
+	//
+	//	while curl -fsS localhost:8080/metrics >/dev/null; do :; done
+	//
+	// and send SIGHUP a few times: the loop keeps going.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			next, err := LoadConfig(*configPath, *format)
+			if err != nil {
+				logErr(slog.LevelError, "reloading config, keeping the old one", err)
+				continue
+			}
+			if *dryRun {
+				next.DryRun = true
+			}
+			c := current.Load().reloaded(next)
+			if changed := c.restartRequired(next); len(changed) > 0 {
+				slog.Warn("config changes that need a restart were not applied", "keys", changed)
+			}
+			current.Store(c)
+			if err := scheduleTargets(c); err != nil {
+				logErr(slog.LevelError, "rescheduling targets", err)
+			}
+			slog.Info("config reloaded", "targets", c.Target.Names())
+		}
+	}()
+
 	<-quitChannel
+	signal.Stop(manualRun)
+	signal.Stop(reload)
+	config = current.Load()
 
 	// Graceful shutdown
 	ctx := scheduler.Stop()
-	<-ctx.Done()
+	schedulerRunning.Store(false)
+	inflight, completed := submissions.drain(time.Duration(config.ShutdownGrace))
+	slog.Info("drained scanner submissions", "in_flight", inflight, "completed", completed)
+	cancelRuns()
+	stopped := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		catchingUp.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Duration(config.ShutdownTimeout)):
+		// a wedged task must not keep the process from exiting
+		slog.Warn("scheduled runs did not stop in time, exiting anyway", "shutdown_timeout", config.ShutdownTimeout)
+	}
+	pendingWebhooks.Wait()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := health.Shutdown(shutdownCtx); err != nil {
+		slog.Error("shutting down health check", "error", err)
+	}
 }
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// names returns the names of packages, sorted.
+func names(packages []Package) []string {
+	var n []string
+	for _, p := range packages {
+		n = append(n, p.Name)
+	}
+	slices.Sort(n)
+	return n
+}
+
+// sentOnce runs a single pass over packages and returns the names the scanner
+// was sent, sorted.
+func sentOnce(t *testing.T, extra map[string]any, packages ...Package) []string {
+	t.Helper()
+	h := newHarness(t, packages...)
+	if err := h.run(h.config(extra)); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	sent := h.scanner.submitted()
+	slices.Sort(sent)
+	return sent
+}
+
+func TestOutOfOrderDependents(t *testing.T) {
+	// npm lists dependents by how depended on they are, not when they were
+	// published, so a fresh package can come after any number of old ones.
+	fresh := func(i int) Package { return Package{Name: fmt.Sprintf("fresh-%02d", i), Date: ago(time.Hour)} }
+	old := func(i int) Package { return Package{Name: fmt.Sprintf("old-%02d", i), Date: ago(30 * 24 * time.Hour)} }
+	tests := []struct {
+		name     string
+		packages func() []Package
+	}{
+		{
+			name: "fresh after old on the same page",
+			packages: func() []Package {
+				return []Package{old(0), old(1), fresh(0), old(2), fresh(1)}
+			},
+		},
+		{
+			name: "fresh only on a later page",
+			packages: func() []Package {
+				var p []Package
+				for i := range defaultPageSize {
+					p = append(p, old(i))
+				}
+				return append(p, fresh(0), fresh(1))
+			},
+		},
+		{
+			name: "interleaved across pages",
+			packages: func() []Package {
+				var p []Package
+				for i := range 3 * defaultPageSize {
+					if i%5 == 0 {
+						p = append(p, fresh(i))
+					} else {
+						p = append(p, old(i))
+					}
+				}
+				return p
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packages := tt.packages()
+			var want []Package
+			for _, p := range packages {
+				if p.Date.TS > ago(2*time.Hour).TS {
+					want = append(want, p)
+				}
+			}
+			got := sentOnce(t, nil, packages...)
+			if !slices.Equal(got, names(want)) {
+				t.Errorf("sent %v, want %v", got, names(want))
+			}
+		})
+	}
+}
+
+func TestDuplicateDependents(t *testing.T) {
+	dup := Package{Name: "dup", Date: ago(time.Hour)}
+	filler := func(n int) []Package {
+		var p []Package
+		for i := range n {
+			p = append(p, Package{Name: fmt.Sprintf("other-%02d", i), Date: ago(time.Hour)})
+		}
+		return p
+	}
+	tests := []struct {
+		name     string
+		packages []Package
+	}{
+		{name: "twice in a row", packages: []Package{dup, dup}},
+		{name: "twice on the same page", packages: slices.Concat([]Package{dup}, filler(3), []Package{dup})},
+		{name: "on different pages", packages: slices.Concat([]Package{dup}, filler(defaultPageSize), []Package{dup})},
+		{name: "three times", packages: slices.Concat([]Package{dup}, filler(2), []Package{dup, dup})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, tt.packages...)
+			if err := h.run(h.config(nil)); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if n := h.scanner.count("dup"); n != 1 {
+				t.Errorf("dup sent %d times, want 1", n)
+			}
+			got := h.scanner.submitted()
+			slices.Sort(got)
+			if want := slices.Compact(names(tt.packages)); !slices.Equal(got, want) {
+				t.Errorf("sent %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCutoff(t *testing.T) {
+	// with an interval of 2 hours, the cutoff is 2 hours before testNow
+	cutoff := testNow.Add(-2 * time.Hour).UnixMilli()
+	tests := []struct {
+		name string
+		date Date
+		sent bool
+	}{
+		{name: "exactly the cutoff", date: Date{TS: cutoff}, sent: true},
+		{name: "just after the cutoff", date: Date{TS: cutoff + 1}, sent: true},
+		{name: "just before the cutoff", date: Date{TS: cutoff - 1}},
+		{name: "now", date: Date{TS: testNow.UnixMilli()}, sent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sentOnce(t, nil, Package{Name: "pkg", Date: tt.date})
+			if sent := len(got) == 1; sent != tt.sent {
+				t.Errorf("sent = %v, want %v", sent, tt.sent)
+			}
+		})
+	}
+}
+
+func TestMissingTimestamp(t *testing.T) {
+	tests := []struct {
+		name string
+		// date is the package's date field as npm sends it, or empty to
+		// leave the field out
+		date string
+		sent bool
+	}{
+		{name: "no date", sent: true},
+		{name: "no timestamp", date: `{}`, sent: true},
+		{name: "zero timestamp", date: `{"ts": 0}`, sent: true},
+		{name: "negative timestamp", date: `{"ts": -1}`, sent: true},
+		{name: "recent relative date", date: `{"rel": "an hour ago"}`, sent: true},
+		{name: "old relative date", date: `{"ts": 0, "rel": "3 hours ago"}`},
+		{name: "unreadable relative date", date: `{"rel": "some time ago"}`, sent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkg := `{"name": "pkg"`
+			if tt.date != "" {
+				pkg += `, "date": ` + tt.date
+			}
+			h := newHarness(t)
+			// served raw, since a Package always encodes its date
+			h.npm.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				page := `{"dependency": "foo", "total": 1, "packages": [` + pkg + `}]}`
+				if r.URL.Query().Has("offset") {
+					page = `{"dependency": "foo", "total": 1, "packages": []}`
+				}
+				w.Header().Set("content-type", "application/json")
+				io.WriteString(w, page)
+			})
+			if err := h.run(h.config(nil)); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if sent := h.scanner.count("pkg") == 1; sent != tt.sent {
+				t.Errorf("sent = %v, want %v", sent, tt.sent)
+			}
+		})
+	}
+}
+
+func TestMinAge(t *testing.T) {
+	minAge := 30 * time.Minute
+	tests := []struct {
+		name string
+		age  time.Duration
+		sent bool
+	}{
+		{name: "just published", age: 0},
+		{name: "just too new", age: minAge - time.Millisecond},
+		{name: "exactly min_age old", age: minAge, sent: true},
+		{name: "older than min_age", age: minAge + time.Millisecond, sent: true},
+		{name: "at the cutoff", age: 2 * time.Hour, sent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, Package{Name: "pkg", Date: ago(tt.age)})
+			c := h.config(map[string]any{"min_age": minAge.String()})
+			if err := h.run(c); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if sent := h.scanner.count("pkg") == 1; sent != tt.sent {
+				t.Errorf("sent = %v, want %v", sent, tt.sent)
+			}
+			// the next run starts where this one stopped considering
+			// packages, so that those too new now are picked up then
+			last, _ := c.State.LastRunFor("foo")
+			if want := testNow.Add(-minAge).UnixMilli(); last != want {
+				t.Errorf("last run = %d, want now - min_age = %d", last, want)
+			}
+		})
+	}
+}
+
+func TestMinAgeConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		extra   map[string]any
+		wantErr string
+	}{
+		{name: "unset", extra: map[string]any{}},
+		{name: "positive", extra: map[string]any{"min_age": "1h"}},
+		{name: "negative", extra: map[string]any{"min_age": "-1m"}, wantErr: "min_age must be positive"},
+		{name: "with top_n", extra: map[string]any{"min_age": "1h", "top_n": 10}, wantErr: "top_n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newHarness(t).load(tt.extra)
+			checkErr(t, err, tt.wantErr)
+		})
+	}
+}
+
+// checkErr fails t unless err contains want, or is nil if want is empty.
+func checkErr(t *testing.T, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case want != "" && err == nil:
+		t.Fatalf("no error, want one containing %q", want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Fatalf("error %q does not contain %q", err, want)
+	}
+}
+
+func TestMaintainerLists(t *testing.T) {
+	extra := map[string]any{
+		"maintainer_allowlist": []string{"alice", "bob"},
+		"maintainer_denylist":  []string{"mallory"},
+	}
+	tests := []struct {
+		name        string
+		maintainers Maintainers
+		old         bool
+		allowed     bool
+		denied      bool
+		sent        bool
+	}{
+		{name: "no maintainers", sent: true},
+		{name: "one allowlisted", maintainers: Maintainers{"alice"}, allowed: true},
+		{name: "all allowlisted", maintainers: Maintainers{"alice", "bob"}, allowed: true},
+		{name: "some allowlisted", maintainers: Maintainers{"alice", "carol"}, sent: true},
+		{name: "none listed", maintainers: Maintainers{"carol", "dave"}, sent: true},
+		{name: "one denylisted", maintainers: Maintainers{"carol", "mallory"}, denied: true, sent: true},
+		{name: "allowlisted and denylisted", maintainers: Maintainers{"alice", "bob", "mallory"}, denied: true, sent: true},
+		{name: "denylisted and old", maintainers: Maintainers{"carol", "mallory"}, old: true, denied: true, sent: true},
+		{name: "allowlisted and old", maintainers: Maintainers{"alice", "bob"}, old: true, allowed: true},
+		{name: "unlisted and old", maintainers: Maintainers{"carol", "dave"}, old: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Package{Name: "pkg", Maintainers: tt.maintainers, Date: ago(time.Hour)}
+			if tt.old {
+				p.Date = ago(30 * 24 * time.Hour)
+			}
+			h := newHarness(t, p)
+			c := h.config(extra)
+			if got := c.allowlisted(p); got != tt.allowed {
+				t.Errorf("allowlisted = %v, want %v", got, tt.allowed)
+			}
+			if got := c.denylisted(p); got != tt.denied {
+				t.Errorf("denylisted = %v, want %v", got, tt.denied)
+			}
+			if err := h.run(c); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if sent := h.scanner.count("pkg") == 1; sent != tt.sent {
+				t.Errorf("sent = %v, want %v", sent, tt.sent)
+			}
+		})
+	}
+}
+
+func TestDeferredPackages(t *testing.T) {
+	// each run covers the 2 hours before it, less min_age
+	extra := map[string]any{"min_age": "30m"}
+	tests := []struct {
+		name string
+		age  time.Duration
+		// runs are when each run starts, after testNow
+		runs []time.Duration
+		// wantSent is how many times the package has been sent after
+		// each run
+		wantSent []int
+	}{
+		{
+			name:     "deferred then sent",
+			age:      10 * time.Minute,
+			runs:     []time.Duration{0, 2 * time.Hour, 4 * time.Hour},
+			wantSent: []int{0, 1, 1},
+		},
+		{
+			name:     "deferred twice then sent",
+			age:      0,
+			runs:     []time.Duration{0, 10 * time.Minute, 40 * time.Minute, time.Hour},
+			wantSent: []int{0, 0, 1, 1},
+		},
+		{
+			name: "sent then in the next window again",
+			age:  time.Hour,
+			// the second run starts before the first window has
+			// passed, as when a run is started by hand
+			runs:     []time.Duration{0, 30 * time.Minute},
+			wantSent: []int{1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, Package{Name: "pkg", Date: ago(tt.age)})
+			c := h.config(extra)
+			for i, at := range tt.runs {
+				c.Clock = fixedClock(testNow.Add(at))
+				if err := h.run(c); err != nil {
+					t.Fatalf("run %d failed: %v", i+1, err)
+				}
+				if got := h.scanner.count("pkg"); got != tt.wantSent[i] {
+					t.Fatalf("after run %d sent %d times, want %d", i+1, got, tt.wantSent[i])
+				}
+				// a deferred package must not be recorded as sent
+				seen, err := c.Store.Has(Package{Name: "pkg"}, c.Scanners[0].Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := tt.wantSent[i] > 0; seen != want {
+					t.Fatalf("after run %d in store = %v, want %v", i+1, seen, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxMaintainers(t *testing.T) {
+	packages := []Package{
+		{Name: "none", Date: ago(time.Hour)},
+		{Name: "several", Maintainers: Maintainers{"alice", "bob", "carol"}, Date: ago(time.Hour)},
+		{Name: "two", Maintainers: Maintainers{"alice", "bob"}, Date: ago(time.Hour)},
+		{Name: "one", Maintainers: Maintainers{"alice"}, Date: ago(time.Hour)},
+	}
+	tests := []struct {
+		name           string
+		maxMaintainers int
+		// want is the order packages are sent in, by a single worker
+		want []string
+	}{
+		{name: "unlimited", want: []string{"none", "several", "two", "one"}},
+		{name: "one", maxMaintainers: 1, want: []string{"one", "none"}},
+		{name: "two", maxMaintainers: 2, want: []string{"one", "none", "two"}},
+		{name: "more than any", maxMaintainers: 5, want: []string{"one", "none", "several", "two"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, packages...)
+			if err := h.run(h.config(map[string]any{"max_maintainers": tt.maxMaintainers, "workers": 1})); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if got := h.scanner.submitted(); !slices.Equal(got, tt.want) {
+				t.Errorf("sent %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	// three pages, at offsets 0, 36 and 72
+	var packages []Package
+	for i := range 3*defaultPageSize - 10 {
+		packages = append(packages, Package{Name: fmt.Sprintf("pkg-%03d", i), Date: ago(time.Hour)})
+	}
+	tests := []struct {
+		name string
+		// stopAt is the offset the first run stops at
+		stopAt int
+		// shutdown stops the first run as a signal would; otherwise
+		// the page fails to fetch
+		shutdown bool
+		// wantOffsets are the pages the second run fetches, in order
+		wantOffsets []int
+	}{
+		{name: "shutdown at the second page", stopAt: 36, shutdown: true, wantOffsets: []int{36, 72, 0}},
+		{name: "shutdown at the last page", stopAt: 72, shutdown: true, wantOffsets: []int{72, 0, 36}},
+		{name: "shutdown at the first page", stopAt: 0, shutdown: true, wantOffsets: []int{0, 36, 72}},
+		{name: "second page fails", stopAt: 36, wantOffsets: []int{36, 72, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t, packages...)
+			c := h.config(map[string]any{"retry_attempts": 1})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			h.npm.fail = func(offset int) int {
+				if offset != tt.stopAt {
+					return 0
+				}
+				if tt.shutdown {
+					cancel()
+				}
+				return http.StatusServiceUnavailable
+			}
+			if err := c.runTriage(ctx, c.Target); err == nil {
+				t.Fatal("first run succeeded, want it to fail")
+			}
+			if got := c.State.CheckpointFor("foo"); got != tt.stopAt {
+				t.Fatalf("checkpoint = %d, want %d", got, tt.stopAt)
+			}
+			if _, ok := c.State.LastRunFor("foo"); ok {
+				t.Fatal("an incomplete run was recorded as the last run")
+			}
+
+			// the next start loads the state the first run saved
+			h.npm.mu.Lock()
+			h.npm.fail, h.npm.offsets = nil, nil
+			h.npm.mu.Unlock()
+			c = h.config(map[string]any{"retry_attempts": 1})
+			if err := h.run(c); err != nil {
+				t.Fatalf("second run failed: %v", err)
+			}
+			if got := h.npm.requested(); !slices.Equal(got, tt.wantOffsets) {
+				t.Errorf("second run fetched offsets %v, want %v", got, tt.wantOffsets)
+			}
+			for _, p := range packages {
+				if n := h.scanner.count(p.Name); n != 1 {
+					t.Errorf("%s sent %d times over both runs, want 1", p.Name, n)
+				}
+			}
+			if got := c.State.CheckpointFor("foo"); got != 0 {
+				t.Errorf("checkpoint = %d after a complete run, want it cleared", got)
+			}
+			if _, ok := c.State.LastRunFor("foo"); !ok {
+				t.Error("complete run not recorded as the last run")
+			}
+		})
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	// the interval is 2 hours
+	tests := []struct {
+		name string
+		// lastRun is how long before testNow the last run was, or 0 if
+		// there has not been one
+		lastRun time.Duration
+		missed  bool
+		// want are the ages of the packages, of those aged 1 to 8
+		// hours, the run sends
+		want []time.Duration
+	}{
+		{name: "never run", want: []time.Duration{time.Hour, 2 * time.Hour}},
+		{name: "last run within the interval", lastRun: time.Hour, want: []time.Duration{time.Hour, 2 * time.Hour}},
+		{name: "last run exactly an interval ago", lastRun: 2 * time.Hour, want: []time.Duration{time.Hour, 2 * time.Hour}},
+		{
+			name: "last run just over an interval ago", lastRun: 2*time.Hour + time.Minute, missed: true,
+			want: []time.Duration{time.Hour, 2 * time.Hour},
+		},
+		{
+			name: "down for hours", lastRun: 5 * time.Hour, missed: true,
+			want: []time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour, 4 * time.Hour, 5 * time.Hour},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var packages []Package
+			for h := 1; h <= 8; h++ {
+				packages = append(packages, Package{Name: fmt.Sprintf("aged-%dh", h), Date: ago(time.Duration(h) * time.Hour)})
+			}
+			h := newHarness(t, packages...)
+			c := h.config(nil)
+			if tt.lastRun > 0 {
+				if err := c.State.SetLastRun("foo", testNow.Add(-tt.lastRun).UnixMilli()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			missed := c.missedRuns()
+			if got := len(missed) == 1; got != tt.missed {
+				t.Errorf("missed = %v, want %v", missed.Names(), tt.missed)
+			}
+			if err := h.run(c); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			var want []string
+			for _, age := range tt.want {
+				want = append(want, fmt.Sprintf("aged-%dh", int(age.Hours())))
+			}
+			slices.Sort(want)
+			got := h.scanner.submitted()
+			slices.Sort(got)
+			if !slices.Equal(got, want) {
+				t.Errorf("sent %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDryRunLeavesStore(t *testing.T) {
+	for _, sk := range storeKinds {
+		t.Run(sk.kind, func(t *testing.T) {
+			h := newHarness(t, Package{Name: "old", Maintainers: Maintainers{"alice"}, Date: ago(time.Hour)})
+			extra := map[string]any{"store": sk.kind, "store_path": filepath.Join(h.dir, sk.file)}
+			c := h.config(extra)
+			if err := h.run(c); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			c.Store.Close()
+			path := filepath.Join(h.dir, sk.file)
+			// backdated, so that a rewrite within the same clock tick
+			// still shows
+			before := time.Now().Add(-time.Hour).Truncate(time.Second)
+			if err := os.Chtimes(path, before, before); err != nil {
+				t.Fatal(err)
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a new package and a new maintainer would both be recorded
+			h.npm.mu.Lock()
+			h.npm.packages = []Package{
+				{Name: "old", Maintainers: Maintainers{"alice", "mallory"}, Date: ago(time.Hour)},
+				{Name: "new", Date: ago(time.Hour)},
+			}
+			h.npm.mu.Unlock()
+			extra["dryrun"] = true
+			c = h.config(extra)
+			if err := h.run(c); err != nil {
+				t.Fatalf("dry run failed: %v", err)
+			}
+			c.Store.Close()
+			if n := h.scanner.count("new"); n != 0 {
+				t.Errorf("dry run sent new %d times", n)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.ModTime().Equal(before) {
+				t.Errorf("store modified at %s by a dry run", info.ModTime())
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("dry run changed the store from\n%s\nto\n%s", want, got)
+			}
+		})
+	}
+}
+
+// rateLimitedFetcher answers the first request with a 429 asking for a retry
+// after a while, as ecosyste.ms does, and serves packages after that.
+type rateLimitedFetcher struct {
+	after    time.Duration
+	packages []Package
+	requests int
+}
+
+func (f *rateLimitedFetcher) FetchDependents(ctx context.Context, target string, offset int) ([]Package, int, error) {
+	f.requests++
+	if f.requests == 1 {
+		return nil, 0, &retryableError{
+			err:   fmt.Errorf("%w: rate limited", ErrUpstreamUnavailable),
+			after: f.after,
+		}
+	}
+	return f.packages, len(f.packages), nil
+}
+
+func TestFetchDependentsRetryAfter(t *testing.T) {
+	h := newHarness(t)
+	// the backoff alone would outlast the test
+	c := h.config(map[string]any{"retry_attempts": 2, "retry_base_delay": "1h", "retry_max_delay": "1h"})
+	f := &rateLimitedFetcher{after: 10 * time.Millisecond, packages: []Package{{Name: "pkg"}}}
+	c.Fetcher = f
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	packages, total, err := c.fetchDependents(ctx, "foo", 0)
+	if err != nil {
+		t.Fatalf("fetchDependents: %v", err)
+	}
+	if f.requests != 2 || total != 1 || !slices.Equal(names(packages), []string{"pkg"}) {
+		t.Errorf("got %v of %d after %d requests, want pkg of 1 after 2", names(packages), total, f.requests)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	packagesTriaged = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "npmwatcher_packages_triaged_total",
+		Help: "Packages successfully sent to the scanner.",
+	})
+	scannerRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "npmwatcher_scanner_requests_total",
+		Help: "Requests made to the scanner, by HTTP status code or \"error\" when no response was received.",
+	}, []string{"status"})
+	scannerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "npmwatcher_scanner_duration_seconds",
+		Help:    "Time until the scanner responded to a submission, by outcome: \"success\", \"failure\" for any status other than 200, or \"error\" when no response was received.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"outcome"})
+	packagesSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "npmwatcher_skipped_total",
+		Help: "Dependents not sent to the scanner, by the first filter that skipped them.",
+	}, []string{"reason"})
+	npmNonJSONResponses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "npmwatcher_npm_non_json_responses_total",
+		Help: "Responses from the npm browse endpoint that were not JSON, such as HTML pages.",
+	})
+	verdicts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "npmwatcher_verdicts_total",
+		Help: "Packages sent to the scanner, by the most severe verdict returned, or \"unknown\" for a verdict that is not recognised or could not be decoded.",
+	}, []string{"verdict"})
+	tarballUploads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "npmwatcher_tarball_uploads_total",
+		Help: "Tarballs of packages the scanner could not find, by outcome: \"uploaded\", \"too_large\", \"fetch_failed\" or \"upload_failed\".",
+	}, []string{"outcome"})
+	triageRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "npmwatcher_triage_runs_total",
+		Help: "Triage runs, by result.",
+	}, []string{"result"})
+	scannerCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "npmwatcher_scanner_circuit_state",
+		Help: "State of each scanner's circuit breaker: 0 closed, 1 half-open, 2 open.",
+	}, []string{"scanner"})
+	lastRunTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "npmwatcher_last_run_timestamp_seconds",
+		Help: "Unix time at which the last triage run finished.",
+	})
+)
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SlackNotifier posts findings to a Slack incoming webhook.
+type SlackNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *SlackNotifier) Notify(f Finding) error {
+	p := f.Package
+	var b strings.Builder
+	if len(f.NewMaintainers) > 0 {
+		fmt.Fprintf(&b, ":busts_in_silhouette: new maintainers on `%s` (dependent of `%s`)\n", p.Name, f.Target)
+		fmt.Fprintf(&b, "*Added:* %s\n", strings.Join(f.NewMaintainers, ", "))
+		fmt.Fprintf(&b, "*Maintainers:* %s\n", strings.Join(p.Maintainers, ", "))
+		return postJSON(s.Client, s.URL, map[string]string{"text": b.String()})
+	}
+	fmt.Fprintf(&b, ":rotating_light: *%s* verdict for `%s@%s` (dependent of `%s`)\n", f.Result.Verdict, p.Name, p.Version, f.Target)
+	fmt.Fprintf(&b, "*Score:* %g\n", f.Result.Score)
+	fmt.Fprintf(&b, "*Publisher:* %s\n", p.Publisher.Name)
+	fmt.Fprintf(&b, "*Maintainers:* %s\n", strings.Join(p.Maintainers, ", "))
+	if len(f.Result.Reasons) > 0 {
+		b.WriteString("*Reasons:*\n")
+		for _, r := range f.Result.Reasons {
+			fmt.Fprintf(&b, "• %s\n", r)
+		}
+	}
+	return postJSON(s.Client, s.URL, map[string]string{"text": b.String()})
+}
+
+// DiscordNotifier posts findings to a Discord webhook as an embed.
+type DiscordNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+type discordEmbed struct {
+	Title       string              `json:"title"`
+	URL         string              `json:"url"`
+	Description string              `json:"description,omitempty"`
+	Color       int                 `json:"color"`
+	Fields      []discordEmbedField `json:"fields"`
+}
+
+type discordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"`
+}
+
+func (d *DiscordNotifier) Notify(f Finding) error {
+	p := f.Package
+	if len(f.NewMaintainers) > 0 {
+		embed := discordEmbed{
+			Title:       fmt.Sprintf("New maintainers on %s", p.Name),
+			URL:         npmPackageURL(p.Name),
+			Description: strings.Join(f.NewMaintainers, "\n"),
+			Color:       0xe67e22,
+			Fields: []discordEmbedField{
+				{Name: "Maintainers", Value: orNone(strings.Join(p.Maintainers, ", "))},
+				{Name: "Dependent of", Value: f.Target, Inline: true},
+			},
+		}
+		return postJSON(d.Client, d.URL, map[string]any{"embeds": []discordEmbed{embed}})
+	}
+	color := 0xf1c40f
+	if f.Result.Verdict == "malicious" {
+		color = 0xe74c3c
+	}
+	embed := discordEmbed{
+		Title:       fmt.Sprintf("%s@%s", p.Name, p.Version),
+		URL:         npmPackageURL(p.Name),
+		Description: strings.Join(f.Result.Reasons, "\n"),
+		Color:       color,
+		Fields: []discordEmbedField{
+			{Name: "Verdict", Value: f.Result.Verdict, Inline: true},
+			{Name: "Score", Value: fmt.Sprintf("%g", f.Result.Score), Inline: true},
+			{Name: "Publisher", Value: orNone(p.Publisher.Name), Inline: true},
+			{Name: "Dependent of", Value: f.Target, Inline: true},
+		},
+	}
+	return postJSON(d.Client, d.URL, map[string]any{"embeds": []discordEmbed{embed}})
+}
+
+// npmPackageURL returns the npmjs.com page for a package.
+func npmPackageURL(name string) string {
+	return "https://www.npmjs.com/package/" + name
+}
+
+// orNone substitutes a placeholder for empty values, which Discord rejects in
+// embed fields.
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// webhookTimeout bounds how long a slow webhook consumer can hold up a
+// forwarded package.
+const webhookTimeout = 3 * time.Second
+
+// pendingWebhooks tracks webhook posts still in flight so that they can finish
+// before the process exits.
+var pendingWebhooks sync.WaitGroup
+
+// triagedEvent describes a package sent to the scanner. It is the body posted
+// to the generic webhook and a line of the output file.
+type triagedEvent struct {
+	Target    string    `json:"target"`
+	Timestamp time.Time `json:"timestamp"`
+	Package   Package   `json:"package"`
+}
+
+// forwardTriaged posts p to the generic webhook, if one is configured. It
+// returns immediately; failures are only logged.
+func (c *Config) forwardTriaged(target string, p Package) {
+	if c.WebhookURL == "" {
+		return
+	}
+	ev := triagedEvent{Target: target, Timestamp: time.Now().UTC(), Package: p}
+	c.postInBackground(c.WebhookURL, ev, "forwarding package to webhook", "target", target, "package", p.Name)
+}
+
+// forwardSummary posts s to the summary webhook, if one is configured. It
+// returns immediately; failures are only logged. Dry runs are not forwarded.
+func (c *Config) forwardSummary(s *RunSummary) {
+	if c.SummaryWebhookURL == "" || c.DryRun {
+		return
+	}
+	c.postInBackground(c.SummaryWebhookURL, s, "forwarding run summary to webhook", "target", s.Target)
+}
+
+// postInBackground posts v to u with a short timeout without waiting for the
+// response. A failure is logged as msg with args.
+func (c *Config) postInBackground(u string, v any, msg string, args ...any) {
+	client := *c.Client
+	client.Timeout = webhookTimeout
+	pendingWebhooks.Add(1)
+	go func() {
+		defer pendingWebhooks.Done()
+		if err := postJSON(&client, u, v); err != nil {
+			logErr(slog.LevelWarn, msg, err, args...)
+		}
+	}()
+}
+
+// postJSON posts v as JSON to u, returning an error if the response is not
+// 2xx.
+func postJSON(client *http.Client, u string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshalling request body: %w", err)
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Add("content-type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		// webhook URLs embed their secret, so only the host is reported.
+		return fmt.Errorf("doing request for %s: %w", req.URL.Host, errors.Unwrap(err))
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &statusError{code: res.StatusCode, url: req.URL.Host}
+	}
+	return nil
+}
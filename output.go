@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// NDJSONFile appends one JSON object per line to a file. Writes are buffered
+// until Flush. Once the file would grow past max bytes it is moved aside to
+// path.1, replacing any earlier one, and a new file started; a max of 0 means
+// no limit. A nil *NDJSONFile is valid and writes nothing.
+type NDJSONFile struct {
+	mu   sync.Mutex
+	path string
+	max  int64
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// OpenNDJSONFile opens path for appending, creating it if needed.
+func OpenNDJSONFile(path string, max int64) (*NDJSONFile, error) {
+	o := &NDJSONFile{path: path, max: max}
+	if err := o.open(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *NDJSONFile) open() error {
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening output file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening output file: %w", err)
+	}
+	o.f, o.w, o.size = f, bufio.NewWriter(f), info.Size()
+	return nil
+}
+
+// Write appends v as a line of JSON.
+func (o *NDJSONFile) Write(v any) error {
+	if o == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshalling output line: %w", err)
+	}
+	b = append(b, '\n')
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.max > 0 && o.size > 0 && o.size+int64(len(b)) > o.max {
+		if err := o.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := o.w.Write(b)
+	o.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("writing output file: %w", err)
+	}
+	return nil
+}
+
+// rotate moves the current file aside and opens a new one. The caller must
+// hold o.mu.
+func (o *NDJSONFile) rotate() error {
+	if err := o.close(); err != nil {
+		return err
+	}
+	if err := os.Rename(o.path, o.path+".1"); err != nil {
+		return fmt.Errorf("rotating output file: %w", err)
+	}
+	return o.open()
+}
+
+// Flush writes buffered lines to the file.
+func (o *NDJSONFile) Flush() error {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.w.Flush(); err != nil {
+		return fmt.Errorf("flushing output file: %w", err)
+	}
+	return nil
+}
+
+func (o *NDJSONFile) Close() error {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.close()
+}
+
+// close flushes and closes the file. The caller must hold o.mu.
+func (o *NDJSONFile) close() error {
+	if err := o.w.Flush(); err != nil {
+		o.f.Close()
+		return fmt.Errorf("flushing output file: %w", err)
+	}
+	if err := o.f.Close(); err != nil {
+		return fmt.Errorf("closing output file: %w", err)
+	}
+	return nil
+}
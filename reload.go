@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+)
+
+// reloaded returns a copy of c with the settings of next that can change
+// while the bot is running: the targets and their schedules, the filters and
+// how runs are paced and retried. Everything else, including the HTTP client,
+// store, state and output files, is kept from c. restartRequired reports the
+// other settings that differ.
+func (c *Config) reloaded(next *Config) *Config {
+	r := *c
+	r.Target, r.IntervalHrs, r.Cron, r.Minute = next.Target, next.IntervalHrs, next.Cron, next.Minute
+	r.Workers, r.MaxPerRun, r.Depth = next.Workers, next.MaxPerRun, next.Depth
+	if c.DependentsSource == "npm" {
+		// the ecosyste.ms fetcher keeps the page size it was created with
+		r.PageSize = next.PageSize
+	}
+	r.IncludeScoped, r.ScanVersioned = next.IncludeScoped, next.ScanVersioned
+	r.MinAge, r.Jitter, r.RunTimeout = next.MinAge, next.Jitter, next.RunTimeout
+	r.ProgressInterval, r.TopN = next.ProgressInterval, next.TopN
+	r.SubmitDelay, r.SubmitJitter = next.SubmitDelay, next.SubmitJitter
+	r.ShutdownGrace, r.ShutdownTimeout = next.ShutdownGrace, next.ShutdownTimeout
+	r.MaintainerAllowlist, r.MaintainerDenylist = next.MaintainerAllowlist, next.MaintainerDenylist
+	r.PopularPackages, r.TyposquatDistance = next.PopularPackages, next.TyposquatDistance
+	r.KeywordWatchlist, r.KeywordIgnoreCutoff = next.KeywordWatchlist, next.KeywordIgnoreCutoff
+	r.NameIncludeRegex, r.NameInclude = next.NameIncludeRegex, next.NameInclude
+	r.NameExcludeRegex, r.NameExclude = next.NameExcludeRegex, next.NameExclude
+	r.IgnoreFile, r.Ignore = next.IgnoreFile, next.Ignore
+	r.MaxMaintainers = next.MaxMaintainers
+	r.NotifyNewMaintainers = next.NotifyNewMaintainers
+	r.AdaptiveBackoff, r.BackoffAfter, r.BackoffMax = next.AdaptiveBackoff, next.BackoffAfter, next.BackoffMax
+	r.RetryAttempts, r.RetryBaseDelay, r.RetryMaxDelay = next.RetryAttempts, next.RetryBaseDelay, next.RetryMaxDelay
+	r.RetryBudget = next.RetryBudget
+	return &r
+}
+
+// restartRequired returns the config keys whose values differ between c and
+// next, ignoring runtime fields.
+func (c *Config) restartRequired(next *Config) []string {
+	var changed []string
+	a, b := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem()
+	for i := range a.NumField() {
+		name, _, _ := strings.Cut(a.Type().Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
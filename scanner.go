@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Scanner analyses packages.
+type Scanner interface {
+	// Name identifies the scanner in logs and in the seen store.
+	Name() string
+	// Submit sends packageName for analysis. Errors worth retrying are
+	// returned as *retryableError.
+	Submit(ctx context.Context, packageName string) (*ScanResult, error)
+}
+
+// HTTPScanner submits packages to the scanner's HTTP API at BaseURL, which
+// must end in a slash. Client must not follow redirects: the scanner
+// redirects requests with a bad API key to its login page.
+type HTTPScanner struct {
+	BaseURL string
+	// ApiKey is sent as the authorization header, prefixed with "Bearer "
+	// if AuthScheme is "bearer". It must never be logged or included in an
+	// error.
+	ApiKey     string
+	AuthScheme string
+	UserAgent  string
+	Client     *http.Client
+	// SlowThreshold, if set, is the response time above which a submission
+	// is logged as slow.
+	SlowThreshold time.Duration
+}
+
+// Name returns the scanner's base URL.
+func (s *HTTPScanner) Name() string {
+	return s.BaseURL
+}
+
+// authorization returns the value of the authorization header.
+func (s *HTTPScanner) authorization() string {
+	if s.AuthScheme == "bearer" {
+		return "Bearer " + s.ApiKey
+	}
+	return s.ApiKey
+}
+
+// authError returns ErrUnauthorized if res shows the API key was rejected.
+func authError(res *http.Response) error {
+	switch res.StatusCode {
+	case http.StatusFound, http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%w: status code %d from %s", ErrUnauthorized, res.StatusCode, redactUserinfo(res.Request.URL.String()))
+	}
+	return nil
+}
+
+// Submit makes a single request to the scanner for packageName and returns
+// its analysis. The result is nil if the response body could not be decoded;
+// the submission itself still succeeded.
+func (s *HTTPScanner) Submit(ctx context.Context, packageName string) (*ScanResult, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.BaseURL+escapePackageName(packageName), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request for dependency %s: %w", packageName, err)
+	}
+	res, err := s.do(req, "package", packageName)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := responseError(res); err != nil {
+		return nil, err
+	}
+	return decodeResult(res, packageName), nil
+}
+
+// decodeResult decodes the analysis of packageName from a 200 response. It
+// returns nil, and logs why, if the body cannot be decoded.
+func decodeResult(res *http.Response, packageName string) *ScanResult {
+	var result ScanResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		slog.Warn("decoding scanner response", "package", packageName, "error", err)
+		return nil
+	}
+	return &result
+}
+
+// setHeaders sets the headers every request to the scanner carries.
+func (s *HTTPScanner) setHeaders(req *http.Request) {
+	req.Header.Set("accept", "application/json")
+	req.Header.Set("authorization", s.authorization())
+	req.Header.Set("user-agent", s.UserAgent)
+}
+
+// do sends req to the scanner and records how long it took and what came
+// back, logging it as slow along with logArgs if it took longer than
+// SlowThreshold. A request that gets no response is returned as a
+// *retryableError; any response, whatever its status, is returned for the
+// caller to check and close.
+func (s *HTTPScanner) do(req *http.Request, logArgs ...any) (*http.Response, error) {
+	ctx := req.Context()
+	s.setHeaders(req)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	start := time.Now()
+	res, err := s.Client.Do(req)
+	elapsed := time.Since(start)
+	if s.SlowThreshold > 0 && elapsed > s.SlowThreshold {
+		slog.Warn("slow scanner response", append([]any{"scanner", redactUserinfo(s.BaseURL), "duration", elapsed}, logArgs...)...)
+	}
+	if err != nil {
+		scannerDuration.WithLabelValues("error").Observe(elapsed.Seconds())
+		scannerRequests.WithLabelValues("error").Inc()
+		return nil, &retryableError{err: fmt.Errorf("%w: sending to scanner: %w", ErrUpstreamUnavailable, redactURLError(err))}
+	}
+	outcome := "success"
+	if res.StatusCode != http.StatusOK {
+		outcome = "failure"
+	}
+	scannerDuration.WithLabelValues(outcome).Observe(elapsed.Seconds())
+	scannerRequests.WithLabelValues(strconv.Itoa(res.StatusCode)).Inc()
+	trace.SpanFromContext(ctx).SetAttributes(semconv.HTTPResponseStatusCode(res.StatusCode))
+	return res, nil
+}
+
+// responseError returns the error for a scanner response other than 200, or
+// nil for a 200.
+func responseError(res *http.Response) error {
+	if err := authError(res); err != nil {
+		return err
+	}
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		return &retryableError{
+			err:   fmt.Errorf("%w: rate limited by %s", ErrUpstreamUnavailable, redactUserinfo(res.Request.URL.String())),
+			after: parseRetryAfter(res.Header.Get("retry-after")),
+		}
+	case res.StatusCode >= 500:
+		return &retryableError{err: &statusError{code: res.StatusCode, url: redactUserinfo(res.Request.URL.String())}}
+	case res.StatusCode != http.StatusOK:
+		return &statusError{code: res.StatusCode, url: redactUserinfo(res.Request.URL.String())}
+	}
+	return nil
+}
+
+// batchResult is the scanner's analysis of one package of a batch.
+type batchResult struct {
+	Package string `json:"package"`
+	ScanResult
+	// Error is set if the package could not be analysed.
+	Error string `json:"error,omitempty"`
+	// Status, if set, is the status code the package would have been
+	// answered with by itself, such as 404 for one the scanner cannot find.
+	Status int `json:"status,omitempty"`
+}
+
+// SubmitBatch sends packageNames to the scanner's batch endpoint, packages
+// alongside BaseURL (so /api/scanner/analyse/packages for the default
+// BaseURL), as a JSON array in a single request. It returns a result and an
+// error for each package, in order, or an error for the whole batch.
+// errBatchUnsupported is returned if the scanner has no batch endpoint.
+func (s *HTTPScanner) SubmitBatch(ctx context.Context, packageNames []string) ([]*ScanResult, []error, error) {
+	base, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing scanner url: %w", err)
+	}
+	u := base.ResolveReference(&url.URL{Path: "../packages"})
+	body, err := json.Marshal(packageNames)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshalling batch: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating batch request: %w", err)
+	}
+	req.Header.Add("content-type", "application/json")
+	res, err := s.do(req, "batch", len(packageNames))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusMethodNotAllowed {
+		return nil, nil, errBatchUnsupported
+	}
+	if err := responseError(res); err != nil {
+		return nil, nil, err
+	}
+	var batch []batchResult
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		return nil, nil, fmt.Errorf("%w from %s: %w", ErrDecodeFailure, redactUserinfo(res.Request.URL.String()), err)
+	}
+	byName := make(map[string]*batchResult, len(batch))
+	for i := range batch {
+		byName[batch[i].Package] = &batch[i]
+	}
+	results := make([]*ScanResult, len(packageNames))
+	errs := make([]error, len(packageNames))
+	for i, name := range packageNames {
+		r, ok := byName[name]
+		switch {
+		case !ok:
+			errs[i] = &retryableError{err: fmt.Errorf("%w: %s missing from batch response", ErrDecodeFailure, name)}
+		case r.Status == http.StatusNotFound:
+			// reported as Submit would, so that tarballScanner can
+			// upload the package itself
+			errs[i] = &statusError{code: r.Status, url: redactUserinfo(s.BaseURL + escapePackageName(name))}
+		case r.Error != "":
+			errs[i] = &retryableError{err: fmt.Errorf("%w: scanner could not analyse %s: %s", ErrUpstreamUnavailable, name, r.Error)}
+		default:
+			results[i] = &r.ScanResult
+		}
+	}
+	return results, errs, nil
+}
+
+// SubmitTarball uploads t, the tarball of packageName, to the same URL Submit
+// requests packageName from, for a scanner that cannot fetch the package
+// itself. The published integrity is sent alongside it in the
+// x-package-integrity header.
+func (s *HTTPScanner) SubmitTarball(ctx context.Context, packageName string, t *Tarball) (*ScanResult, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.BaseURL+escapePackageName(packageName), bytes.NewReader(t.Data))
+	if err != nil {
+		return nil, fmt.Errorf("creating tarball upload for %s: %w", packageName, err)
+	}
+	req.Header.Add("content-type", "application/gzip")
+	req.Header.Add("x-package-integrity", t.Integrity)
+	res, err := s.do(req, "package", packageName, "tarball", t.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := responseError(res); err != nil {
+		return nil, err
+	}
+	return decodeResult(res, packageName), nil
+}
+
+// Ping makes an authenticated request to the scanner base URL to check that
+// the API key is accepted. Only a rejected key is an error; the base URL may
+// well not be a valid endpoint by itself.
+func (s *HTTPScanner) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.BaseURL, nil)
+	if err != nil {
+		return fmt.Errorf("creating scanner ping request: %w", err)
+	}
+	s.setHeaders(req)
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: pinging scanner: %w", ErrUpstreamUnavailable, redactURLError(err))
+	}
+	res.Body.Close()
+	return authError(res)
+}
+
+// escapePackageName escapes a package name for use as a single path segment,
+// so that a scoped name like @scope/name becomes %40scope%2Fname.
+func escapePackageName(name string) string {
+	return strings.ReplaceAll(url.PathEscape(name), "@", "%40")
+}
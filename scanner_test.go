@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEscapePackageName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "foo", want: "foo"},
+		{name: "@scope/name", want: "%40scope%2Fname"},
+		{name: "@scope/name@1.2.3", want: "%40scope%2Fname%401.2.3"},
+		{name: "foo@1.0.0-beta.1", want: "foo%401.0.0-beta.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := escapePackageName(tt.name)
+			if got != tt.want {
+				t.Errorf("escapePackageName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+			back, err := url.PathUnescape(got)
+			if err != nil || back != tt.name {
+				t.Errorf("PathUnescape(%q) = %q, %v, want %q", got, back, err, tt.name)
+			}
+		})
+	}
+}
+
+// TestSubmitScopedName checks that a scoped name arrives at the scanner as a
+// single path segment and decodes back to the name.
+func TestSubmitScopedName(t *testing.T) {
+	var rawPath, path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawPath, path = r.URL.EscapedPath(), r.URL.Path
+		w.Write([]byte(`{"verdict":"benign"}`))
+	}))
+	defer srv.Close()
+	s := &HTTPScanner{BaseURL: srv.URL + "/scan/", ApiKey: "key", Client: srv.Client()}
+	if _, err := s.Submit(context.Background(), "@scope/name"); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if rawPath != "/scan/%40scope%2Fname" {
+		t.Errorf("scanner got path %q, want /scan/%%40scope%%2Fname", rawPath)
+	}
+	if path != "/scan/@scope/name" {
+		t.Errorf("scanner path decodes to %q, want /scan/@scope/name", path)
+	}
+}
+
+func TestIncludeScoped(t *testing.T) {
+	packages := []Package{
+		{Name: "plain", Date: ago(time.Hour)},
+		{Name: "@scope/name", Date: ago(time.Hour)},
+	}
+	tests := []struct {
+		includeScoped bool
+		want          []string
+	}{
+		{includeScoped: false, want: []string{"plain"}},
+		{includeScoped: true, want: []string{"@scope/name", "plain"}},
+	}
+	for _, tt := range tests {
+		got := sentOnce(t, map[string]any{"include_scoped": tt.includeScoped}, packages...)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("include_scoped %v: sent %v, want %v", tt.includeScoped, got, tt.want)
+		}
+	}
+}
+
+func TestScannerAuthErrors(t *testing.T) {
+	tests := []struct {
+		name             string
+		code             int
+		wantUnauthorized bool
+	}{
+		{name: "ok", code: http.StatusOK},
+		{name: "redirect to the login page", code: http.StatusFound, wantUnauthorized: true},
+		{name: "unauthorized", code: http.StatusUnauthorized, wantUnauthorized: true},
+		{name: "forbidden", code: http.StatusForbidden, wantUnauthorized: true},
+		{name: "server error", code: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/scan/", func(w http.ResponseWriter, r *http.Request) {
+				if tt.code == http.StatusFound {
+					http.Redirect(w, r, "/login", tt.code)
+					return
+				}
+				w.WriteHeader(tt.code)
+				w.Write([]byte(`{"verdict":"benign"}`))
+			})
+			// the login page itself is a 200, which following the
+			// redirect would mistake for an analysis
+			mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`<html>log in</html>`))
+			})
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+			h := &harness{t: t, dir: t.TempDir(), npm: newFakeNPM(t, "foo"), scanner: &fakeScanner{Server: srv}}
+			c := h.config(nil)
+
+			_, err := c.Scanners[0].Submit(context.Background(), "pkg")
+			if got := errors.Is(err, ErrUnauthorized); got != tt.wantUnauthorized {
+				t.Errorf("Submit returned %v, want unauthorized = %v", err, tt.wantUnauthorized)
+			}
+			if tt.code == http.StatusOK && err != nil {
+				t.Errorf("Submit: %v", err)
+			}
+			ping := (&HTTPScanner{BaseURL: srv.URL + "/scan/", Client: c.Client}).Ping(context.Background())
+			if got := errors.Is(ping, ErrUnauthorized); got != tt.wantUnauthorized {
+				t.Errorf("Ping returned %v, want unauthorized = %v", ping, tt.wantUnauthorized)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	cron "github.com/pardnchiu/go-cron"
+)
+
+// printedRuns is how many upcoming runs --print-schedule lists per target.
+const printedRuns = 5
+
+// errScheduleShape is returned when go-cron parses a spec into something
+// other than the types nextRuns knows how to read, which means go-cron has
+// changed and --print-schedule needs updating with it.
+var errScheduleShape = errors.New("unrecognised go-cron schedule, --print-schedule needs updating for this go-cron version")
+
+// printSchedule writes the cron expression each target is scheduled with and
+// its next printedRuns fire times after now to w. It backs --print-schedule.
+func (c *Config) printSchedule(w io.Writer, now time.Time) error {
+	fmt.Fprintln(w, "schedule (UTC):")
+	for _, t := range c.Target {
+		spec := t.schedule()
+		fmt.Fprintf(w, "  %s: %q, covering %dh\n", t.Name, spec, t.IntervalHrs)
+		runs, err := nextRuns(spec, now.UTC(), printedRuns)
+		if err != nil {
+			return fmt.Errorf("target %s: %w", t.Name, err)
+		}
+		if len(runs) == 0 {
+			fmt.Fprintln(w, "    never")
+		}
+		for _, r := range runs {
+			fmt.Fprintf(w, "    %s\n", r.Format(time.RFC3339))
+		}
+	}
+	if c.Jitter > 0 {
+		fmt.Fprintf(w, "each run starts up to %s after its fire time\n", c.Jitter)
+	}
+	return nil
+}
+
+// nextRuns returns up to n times after from that spec fires at, or fewer if
+// it stops matching within a leap year cycle.
+//
+// The fire times cannot simply be read off the scheduler: the Next of a task
+// in List is only set once the scheduler is started, from time.Now rather than
+// from, by the scheduler's goroutine without holding the lock List takes, and
+// only ever for the one run ahead. So spec is parsed by go-cron, which is
+// therefore what decides the syntax, and the parsed fields are stepped through
+// here the way go-cron's own unexported next does, minute by minute. Note its
+// "*/n" matches values divisible by n rather than every nth value from the
+// start of the range. schedule_test.go pins both halves against go-cron.
+func nextRuns(spec string, from time.Time, n int) ([]time.Time, error) {
+	s, err := parseSchedule(spec)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", spec, err)
+	}
+	if s.every > 0 {
+		// the scheduler counts from when it started
+		runs := make([]time.Time, n)
+		for i := range runs {
+			runs[i] = from.Add(time.Duration(i+1) * s.every)
+		}
+		return runs, nil
+	}
+	var runs []time.Time
+	t := from.Truncate(time.Minute)
+	for end := t.AddDate(4, 0, 0); len(runs) < n && t.Before(end); {
+		t = t.Add(time.Minute)
+		if s.match(t) {
+			runs = append(runs, t)
+		}
+	}
+	return runs, nil
+}
+
+// cronField is one field of a parsed cron expression, as go-cron's
+// scheduleField: any value, values divisible by step, or a single value.
+type cronField struct {
+	any   bool
+	step  int
+	value int
+}
+
+func (f cronField) match(v int) bool {
+	switch {
+	case f.any:
+		return true
+	case f.step > 0:
+		return v%f.step == 0
+	}
+	return f.value == v
+}
+
+// cronSchedule is a spec as parsed by go-cron: either a fixed interval for
+// "@every" or five cron fields for everything else.
+type cronSchedule struct {
+	every                         time.Duration
+	minute, hour, dom, month, dow cronField
+}
+
+func (s cronSchedule) match(t time.Time) bool {
+	return s.minute.match(t.Minute()) && s.hour.match(t.Hour()) &&
+		s.dom.match(t.Day()) && s.month.match(int(t.Month())) && s.dow.match(int(t.Weekday()))
+}
+
+// parseSchedule has go-cron parse spec, by adding it to a scheduler that is
+// never started, and reads the result back out of List. go-cron does not
+// export the types it parses into, so their fields are read by reflection.
+func parseSchedule(spec string) (cronSchedule, error) {
+	scheduler, err := cron.New(cron.Config{Location: time.UTC})
+	if err != nil {
+		return cronSchedule{}, err
+	}
+	if _, err := scheduler.Add(spec, func() {}); err != nil {
+		return cronSchedule{}, err
+	}
+	tasks := scheduler.List()
+	if len(tasks) != 1 {
+		return cronSchedule{}, errScheduleShape
+	}
+	v := reflect.ValueOf(tasks[0].Schedule)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return cronSchedule{}, errScheduleShape
+	}
+
+	var s cronSchedule
+	switch v.Type().Name() {
+	case "delayScheduleResult":
+		d := v.FieldByName("delay")
+		if !d.IsValid() || d.Type() != reflect.TypeFor[time.Duration]() {
+			return cronSchedule{}, errScheduleShape
+		}
+		s.every = time.Duration(d.Int())
+		return s, nil
+	case "scheduleResult":
+		for name, f := range map[string]*cronField{
+			"minute": &s.minute, "hour": &s.hour, "dom": &s.dom, "month": &s.month, "dow": &s.dow,
+		} {
+			var ok bool
+			if *f, ok = scheduleField(v.FieldByName(name)); !ok {
+				return cronSchedule{}, errScheduleShape
+			}
+		}
+		return s, nil
+	}
+	return cronSchedule{}, errScheduleShape
+}
+
+// scheduleField reads a go-cron scheduleField, reporting false if v is not one.
+func scheduleField(v reflect.Value) (cronField, bool) {
+	if v.Kind() != reflect.Struct {
+		return cronField{}, false
+	}
+	value, all, step := v.FieldByName("Value"), v.FieldByName("All"), v.FieldByName("Step")
+	if value.Kind() != reflect.Int || all.Kind() != reflect.Bool || step.Kind() != reflect.Int {
+		return cronField{}, false
+	}
+	return cronField{any: all.Bool(), step: int(step.Int()), value: int(value.Int())}, true
+}
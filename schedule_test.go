@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseSchedule pins what go-cron parses specs into, which nextRuns reads
+// by reflection. A failure here after upgrading go-cron means nextRuns needs
+// updating to match.
+func TestParseSchedule(t *testing.T) {
+	all := cronField{any: true}
+	tests := []struct {
+		spec    string
+		want    cronSchedule
+		wantErr bool
+	}{
+		{spec: "@hourly", want: cronSchedule{minute: cronField{}, hour: all, dom: all, month: all, dow: all}},
+		{spec: "@daily", want: cronSchedule{hour: cronField{}, dom: all, month: all, dow: all}},
+		{spec: "@weekly", want: cronSchedule{dom: all, month: all}},
+		{spec: "@monthly", want: cronSchedule{dom: cronField{value: 1}, month: all, dow: all}},
+		{spec: "@yearly", want: cronSchedule{dom: cronField{value: 1}, month: cronField{value: 1}, dow: all}},
+		{spec: "@every 90m", want: cronSchedule{every: 90 * time.Minute}},
+		{spec: "*/15 */6 * * *", want: cronSchedule{
+			minute: cronField{step: 15}, hour: cronField{step: 6}, dom: all, month: all, dow: all,
+		}},
+		{spec: "30 4 1 * 0", want: cronSchedule{
+			minute: cronField{value: 30}, hour: cronField{value: 4}, dom: cronField{value: 1}, month: all,
+		}},
+		{spec: "* * *", wantErr: true},
+		{spec: "@every 10s", wantErr: true},
+		{spec: "1-5 * * * *", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseSchedule(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseSchedule(%q) = %+v, want an error", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSchedule(%q): %v", tt.spec, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseSchedule(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestNextRuns pins nextRuns to go-cron's matching rules, including those that
+// differ from other cron implementations.
+func TestNextRuns(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	from := at("2026-03-01T10:50:30Z") // a Sunday
+	tests := []struct {
+		name string
+		spec string
+		n    int
+		want []string
+	}{
+		{
+			name: "runs are strictly after from",
+			spec: "50 10 * * *", n: 2,
+			want: []string{"2026-03-02T10:50:00Z", "2026-03-03T10:50:00Z"},
+		},
+		{
+			name: "minute step wraps into the next hour",
+			spec: "*/7 * * * *", n: 3,
+			want: []string{"2026-03-01T10:56:00Z", "2026-03-01T11:00:00Z", "2026-03-01T11:07:00Z"},
+		},
+		{
+			name: "day of month step matches days divisible by it",
+			spec: "0 0 */2 * *", n: 3,
+			want: []string{"2026-03-02T00:00:00Z", "2026-03-04T00:00:00Z", "2026-03-06T00:00:00Z"},
+		},
+		{
+			name: "step of zero matches zero only",
+			spec: "*/0 12 * * *", n: 1,
+			want: []string{"2026-03-01T12:00:00Z"},
+		},
+		{
+			name: "day of week zero is sunday",
+			spec: "@weekly", n: 2,
+			want: []string{"2026-03-08T00:00:00Z", "2026-03-15T00:00:00Z"},
+		},
+		{
+			name: "every counts from from",
+			spec: "@every 2h", n: 2,
+			want: []string{"2026-03-01T12:50:30Z", "2026-03-01T14:50:30Z"},
+		},
+		{
+			name: "impossible date never runs",
+			spec: "0 0 31 2 *", n: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nextRuns(tt.spec, from, tt.n)
+			if err != nil {
+				t.Fatalf("nextRuns(%q): %v", tt.spec, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("nextRuns(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+			for i, w := range tt.want {
+				if !got[i].Equal(at(w)) {
+					t.Errorf("nextRuns(%q)[%d] = %s, want %s", tt.spec, i, got[i].Format(time.RFC3339), w)
+				}
+			}
+		})
+	}
+}
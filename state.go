@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RunState records when each target was last triaged successfully, so that
+// after downtime the next run can cover the window that was missed. It is
+// persisted as a JSON file. A nil *RunState is valid and remembers nothing.
+type RunState struct {
+	mu   sync.Mutex
+	path string
+	// LastRun maps a target to the unix millisecond timestamp at which its
+	// last successful run started.
+	LastRun map[string]int64 `json:"last_run"`
+	// Checkpoint maps a target to the offset of the page that its last run
+	// failed to fetch, for the next run to resume from.
+	Checkpoint map[string]int `json:"checkpoint,omitempty"`
+	// Paused is set while scheduled runs are paused through the API.
+	Paused bool `json:"paused,omitempty"`
+}
+
+// LoadRunState reads the state file at path. A missing file is treated as a
+// first run.
+func LoadRunState(path string) (*RunState, error) {
+	s := &RunState{path: path, LastRun: make(map[string]int64), Checkpoint: make(map[string]int)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading state file: %w", err)
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("unmarshalling state file %s: %w", path, err)
+	}
+	if s.LastRun == nil {
+		s.LastRun = make(map[string]int64)
+	}
+	if s.Checkpoint == nil {
+		s.Checkpoint = make(map[string]int)
+	}
+	return s, nil
+}
+
+// LastRunFor returns the start of the last successful run for target.
+func (s *RunState) LastRunFor(target string) (int64, bool) {
+	if s == nil {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts, ok := s.LastRun[target]
+	return ts, ok
+}
+
+// SetLastRun records ts as the start of the last successful run for target
+// and writes the state to disk.
+func (s *RunState) SetLastRun(target string, ts int64) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastRun[target] = ts
+	return s.save()
+}
+
+// CheckpointFor returns the offset the next run of target should resume from,
+// or 0 if it should start from the beginning.
+func (s *RunState) CheckpointFor(target string) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Checkpoint[target]
+}
+
+// SetCheckpoint records offset as the page the next run of target should
+// resume from and writes the state to disk.
+func (s *RunState) SetCheckpoint(target string, offset int) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Checkpoint[target] = offset
+	return s.save()
+}
+
+// ClearCheckpoint removes any checkpoint for target.
+func (s *RunState) ClearCheckpoint(target string) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Checkpoint[target]; !ok {
+		return nil
+	}
+	delete(s.Checkpoint, target)
+	return s.save()
+}
+
+// IsPaused reports whether scheduled runs were paused when the state was
+// last saved.
+func (s *RunState) IsPaused() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Paused
+}
+
+// SetPaused records whether scheduled runs are paused and writes the state to
+// disk.
+func (s *RunState) SetPaused(paused bool) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Paused = paused
+	return s.save()
+}
+
+// save writes the state to disk. The caller must hold s.mu.
+func (s *RunState) save() error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("marshalling state file: %w", err)
+	}
+	if err := writeFileAtomic(s.path, b); err != nil {
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Store persists what the watcher has seen across runs: the package versions
+// already sent to the scanner, with their verdicts, and the maintainers last
+// seen on each package.
+type Store interface {
+	// Has reports whether p has been accepted by scanner before. Entries
+	// recorded before scanners were tracked count for every scanner.
+	Has(p Package, scanner string) (bool, error)
+	// Add records p as accepted by scanners on behalf of target, in addition
+	// to any scanners that accepted it earlier. result is nil if no scanner
+	// returned a verdict.
+	Add(p Package, target string, scanners []string, result *ScanResult) error
+	// UpdateMaintainers records maintainers as the current maintainers of
+	// the package name and returns those that were not present last time it
+	// was seen. Nothing is reported the first time a package is seen.
+	UpdateMaintainers(name string, maintainers []string) ([]string, error)
+	// Save flushes changes held in memory.
+	Save() error
+	// List returns the package versions sent that match f, most recently
+	// sent first.
+	List(f SeenFilter) ([]SeenRecord, error)
+	// AddFinding records a finding as soon as it is made, before it is
+	// passed to any notifier.
+	AddFinding(r FindingRecord) error
+	// Findings returns the findings that match f, most recent first.
+	Findings(f FindingFilter) ([]FindingRecord, error)
+	// Len returns the number of package versions sent.
+	Len() int
+	Close() error
+}
+
+// SeenFilter selects records from a Store. Zero fields match everything.
+type SeenFilter struct {
+	Target string
+	// Verdicts, if set, limits the records to those with one of these
+	// verdicts.
+	Verdicts []string
+	Limit    int
+}
+
+// SeenRecord is a package version recorded as sent to the scanner.
+type SeenRecord struct {
+	Package string      `json:"package"`
+	Target  string      `json:"target"`
+	SentAt  time.Time   `json:"sent_at"`
+	Result  *ScanResult `json:"result,omitempty"`
+}
+
+// matches reports whether r is selected by f, ignoring f.Limit.
+func (f *SeenFilter) matches(r *SeenRecord) bool {
+	if f.Target != "" && r.Target != f.Target {
+		return false
+	}
+	if f.Verdicts != nil && (r.Result == nil || !slices.Contains(f.Verdicts, r.Result.Verdict)) {
+		return false
+	}
+	return true
+}
+
+// FindingRecord is a Finding as recorded in a Store.
+type FindingRecord struct {
+	FoundAt time.Time `json:"found_at"`
+	Finding
+}
+
+// FindingFilter selects findings from a Store. Zero fields match everything.
+type FindingFilter struct {
+	Target string
+	// MinScore, if set, limits the findings to those scored at least this
+	// high. Findings of new maintainers have no score.
+	MinScore float64
+	// Since and Until bound when the findings were made, inclusively.
+	Since, Until time.Time
+	Limit        int
+}
+
+// matches reports whether r is selected by f, ignoring f.Limit.
+func (f *FindingFilter) matches(r *FindingRecord) bool {
+	switch {
+	case f.Target != "" && r.Target != f.Target:
+		return false
+	case f.MinScore != 0 && r.Result.Score < f.MinScore:
+		return false
+	case !f.Since.IsZero() && r.FoundAt.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && r.FoundAt.After(f.Until):
+		return false
+	}
+	return true
+}
+
+// OpenStore opens the store of the given kind ("json" or "sqlite") at path. If
+// path is empty a store that remembers nothing is returned.
+func OpenStore(kind, path string) (Store, error) {
+	if path == "" {
+		return noStore{}, nil
+	}
+	switch kind {
+	case "sqlite":
+		return OpenSQLiteStore(path)
+	default:
+		return LoadSeenStore(path)
+	}
+}
+
+// noStore is used when no store is configured. It remembers nothing.
+type noStore struct{}
+
+func (noStore) Has(Package, string) (bool, error)                    { return false, nil }
+func (noStore) Add(Package, string, []string, *ScanResult) error     { return nil }
+func (noStore) UpdateMaintainers(string, []string) ([]string, error) { return nil, nil }
+func (noStore) Save() error                                          { return nil }
+func (noStore) List(SeenFilter) ([]SeenRecord, error)                { return nil, nil }
+func (noStore) AddFinding(FindingRecord) error                       { return nil }
+func (noStore) Findings(FindingFilter) ([]FindingRecord, error)      { return nil, nil }
+func (noStore) Len() int                                             { return 0 }
+func (noStore) Close() error                                         { return nil }
+
+// SeenStore is a Store persisted as a JSON file. A nil *SeenStore is valid and
+// remembers nothing.
+type SeenStore struct {
+	mu          sync.RWMutex
+	path        string
+	Seen        map[string]SeenEntry `json:"seen"`
+	Maintainers map[string][]string  `json:"maintainers,omitempty"`
+	// FindingLog holds every finding, oldest first.
+	FindingLog []FindingRecord `json:"findings,omitempty"`
+}
+
+type SeenEntry struct {
+	Target string      `json:"target"`
+	SentAt time.Time   `json:"sent_at"`
+	Result *ScanResult `json:"result,omitempty"`
+	// Scanners lists the scanners that accepted the package. It is empty
+	// for entries recorded before scanners were tracked.
+	Scanners []string `json:"scanners,omitempty"`
+}
+
+// seenKey identifies a package version in the store.
+func seenKey(p Package) string {
+	return p.Name + "@" + p.Version
+}
+
+// LoadSeenStore reads the store at path. A missing file is treated as an
+// empty store.
+func LoadSeenStore(path string) (*SeenStore, error) {
+	s := &SeenStore{path: path, Seen: make(map[string]SeenEntry), Maintainers: make(map[string][]string)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading seen store: %w", err)
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("unmarshalling seen store %s: %w", path, err)
+	}
+	if s.Seen == nil {
+		s.Seen = make(map[string]SeenEntry)
+	}
+	if s.Maintainers == nil {
+		s.Maintainers = make(map[string][]string)
+	}
+	return s, nil
+}
+
+func (s *SeenStore) Has(p Package, scanner string) (bool, error) {
+	if s == nil {
+		return false, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.Seen[seenKey(p)]
+	return ok && (len(e.Scanners) == 0 || slices.Contains(e.Scanners, scanner)), nil
+}
+
+// Add records p as sent and writes the store to disk.
+func (s *SeenStore) Add(p Package, target string, scanners []string, result *ScanResult) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := seenKey(p)
+	e := s.Seen[key]
+	e.Target, e.SentAt = target, time.Now().UTC()
+	if result != nil {
+		e.Result = result
+	}
+	for _, scanner := range scanners {
+		if !slices.Contains(e.Scanners, scanner) {
+			e.Scanners = append(e.Scanners, scanner)
+		}
+	}
+	s.Seen[key] = e
+	return s.save()
+}
+
+// UpdateMaintainers only changes the store in memory until Save is called.
+func (s *SeenStore) UpdateMaintainers(name string, maintainers []string) ([]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.Maintainers[name]
+	s.Maintainers[name] = maintainers
+	if !ok {
+		return nil, nil
+	}
+	return addedMaintainers(previous, maintainers), nil
+}
+
+// addedMaintainers returns the elements of current missing from previous.
+func addedMaintainers(previous, current []string) []string {
+	var added []string
+	for _, m := range current {
+		if !slices.Contains(previous, m) {
+			added = append(added, m)
+		}
+	}
+	return added
+}
+
+// Save writes the store to disk.
+func (s *SeenStore) Save() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+func (s *SeenStore) List(f SeenFilter) ([]SeenRecord, error) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.RLock()
+	var records []SeenRecord
+	for key, e := range s.Seen {
+		r := SeenRecord{Package: key, Target: e.Target, SentAt: e.SentAt, Result: e.Result}
+		if f.matches(&r) {
+			records = append(records, r)
+		}
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(records, func(a, b SeenRecord) int {
+		return b.SentAt.Compare(a.SentAt)
+	})
+	if f.Limit > 0 && len(records) > f.Limit {
+		records = records[:f.Limit]
+	}
+	return records, nil
+}
+
+// AddFinding records r and writes the store to disk.
+func (s *SeenStore) AddFinding(r FindingRecord) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.FindingLog = append(s.FindingLog, r)
+	return s.save()
+}
+
+func (s *SeenStore) Findings(f FindingFilter) ([]FindingRecord, error) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var records []FindingRecord
+	for i := len(s.FindingLog) - 1; i >= 0; i-- {
+		if f.matches(&s.FindingLog[i]) {
+			records = append(records, s.FindingLog[i])
+			if len(records) == f.Limit {
+				break
+			}
+		}
+	}
+	return records, nil
+}
+
+func (s *SeenStore) Len() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.Seen)
+}
+
+func (s *SeenStore) Close() error {
+	return nil
+}
+
+// save writes the store to disk. The caller must hold s.mu.
+func (s *SeenStore) save() error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("marshalling seen store: %w", err)
+	}
+	if err := writeFileAtomic(s.path, b); err != nil {
+		return fmt.Errorf("writing seen store: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes b to a temporary file and renames it over path so a
+// crash mid-write does not leave a truncated file behind.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
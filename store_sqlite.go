@@ -0,0 +1,365 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order to bring a database up to date. The number
+// applied so far is kept in the database's user_version. Existing entries
+// must never be changed; add a new one instead.
+var migrations = []string{
+	`CREATE TABLE seen (
+		key     TEXT PRIMARY KEY,
+		name    TEXT NOT NULL,
+		version TEXT NOT NULL,
+		target  TEXT NOT NULL,
+		sent_at TEXT NOT NULL
+	);
+	CREATE INDEX seen_name ON seen (name);
+	CREATE TABLE verdicts (
+		key     TEXT PRIMARY KEY REFERENCES seen (key),
+		verdict TEXT NOT NULL,
+		score   REAL NOT NULL,
+		reasons TEXT NOT NULL
+	);
+	CREATE TABLE maintainers (
+		name       TEXT NOT NULL,
+		maintainer TEXT NOT NULL,
+		first_seen TEXT NOT NULL,
+		PRIMARY KEY (name, maintainer)
+	);
+	CREATE TABLE packages (
+		name      TEXT PRIMARY KEY,
+		last_seen TEXT NOT NULL
+	);`,
+	`CREATE TABLE seen_scanners (
+		key     TEXT NOT NULL REFERENCES seen (key),
+		scanner TEXT NOT NULL,
+		sent_at TEXT NOT NULL,
+		PRIMARY KEY (key, scanner)
+	);`,
+	`CREATE TABLE findings (
+		id       INTEGER PRIMARY KEY,
+		target   TEXT NOT NULL,
+		key      TEXT NOT NULL,
+		found_at TEXT NOT NULL,
+		score    REAL NOT NULL,
+		finding  TEXT NOT NULL
+	);
+	CREATE INDEX findings_found_at ON findings (found_at);`,
+	// found_at was written as RFC 3339 with the trailing zeros of its
+	// fraction dropped, which does not sort as text; pad it to
+	// foundAtLayout.
+	`UPDATE findings SET found_at = substr(found_at, 1, 19) || '.' ||
+		substr(CASE WHEN substr(found_at, 20, 1) = '.'
+			THEN substr(found_at, 21, length(found_at) - 21) ELSE '' END || '000000000', 1, 9) || 'Z';`,
+}
+
+// foundAtLayout is how found_at is stored: always in UTC and with all nine
+// digits of the fraction, so that the text sorts in time order.
+const foundAtLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// SQLiteStore is a Store kept in a SQLite database, which unlike SeenStore
+// does not have to be rewritten in full on every change and can be queried
+// directly.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore opens or creates the database at path and applies any
+// outstanding migrations.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening sqlite store: %w", err)
+	}
+	// writes from concurrent workers would otherwise fail with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA journal_mode = WAL; PRAGMA foreign_keys = ON"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("configuring sqlite store %s: %w", path, err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating sqlite store %s: %w", path, err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database is at version %d, newer than this build (%d)", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// PRAGMA does not take bound parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Has(p Package, scanner string) (bool, error) {
+	// rows in seen without any in seen_scanners predate scanner tracking
+	var seen bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM seen_scanners WHERE key = ?1 AND scanner = ?2)
+		OR (EXISTS (SELECT 1 FROM seen WHERE key = ?1)
+			AND NOT EXISTS (SELECT 1 FROM seen_scanners WHERE key = ?1))`,
+		seenKey(p), scanner).Scan(&seen)
+	if err != nil {
+		return false, fmt.Errorf("querying seen packages: %w", err)
+	}
+	return seen, nil
+}
+
+func (s *SQLiteStore) Add(p Package, target string, scanners []string, result *ScanResult) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("recording %s: %w", seenKey(p), err)
+	}
+	defer tx.Rollback()
+	key := seenKey(p)
+	_, err = tx.Exec(`INSERT INTO seen (key, name, version, target, sent_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET target = excluded.target, sent_at = excluded.sent_at`,
+		key, p.Name, p.Version, target, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("recording %s: %w", key, err)
+	}
+	for _, scanner := range scanners {
+		_, err = tx.Exec(`INSERT INTO seen_scanners (key, scanner, sent_at) VALUES (?, ?, ?)
+			ON CONFLICT (key, scanner) DO UPDATE SET sent_at = excluded.sent_at`,
+			key, scanner, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			return fmt.Errorf("recording %s as sent to %s: %w", key, scanner, err)
+		}
+	}
+	if result != nil {
+		reasons, err := json.Marshal(result.Reasons)
+		if err != nil {
+			return fmt.Errorf("marshalling reasons for %s: %w", key, err)
+		}
+		_, err = tx.Exec(`INSERT INTO verdicts (key, verdict, score, reasons) VALUES (?, ?, ?, ?)
+			ON CONFLICT (key) DO UPDATE SET verdict = excluded.verdict, score = excluded.score, reasons = excluded.reasons`,
+			key, result.Verdict, result.Score, string(reasons))
+		if err != nil {
+			return fmt.Errorf("recording verdict for %s: %w", key, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateMaintainers writes the change straight away.
+func (s *SQLiteStore) UpdateMaintainers(name string, maintainers []string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("updating maintainers of %s: %w", name, err)
+	}
+	defer tx.Rollback()
+	var lastSeen string
+	err = tx.QueryRow("SELECT last_seen FROM packages WHERE name = ?", name).Scan(&lastSeen)
+	known := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("querying maintainers of %s: %w", name, err)
+	}
+	rows, err := tx.Query("SELECT maintainer FROM maintainers WHERE name = ?", name)
+	if err != nil {
+		return nil, fmt.Errorf("querying maintainers of %s: %w", name, err)
+	}
+	var previous []string
+	for rows.Next() {
+		var m string
+		if err := rows.Scan(&m); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("querying maintainers of %s: %w", name, err)
+		}
+		previous = append(previous, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("querying maintainers of %s: %w", name, err)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	added := addedMaintainers(previous, maintainers)
+	for _, m := range added {
+		if _, err := tx.Exec("INSERT INTO maintainers (name, maintainer, first_seen) VALUES (?, ?, ?)", name, m, now); err != nil {
+			return nil, fmt.Errorf("recording maintainer of %s: %w", name, err)
+		}
+	}
+	for _, m := range addedMaintainers(maintainers, previous) {
+		if _, err := tx.Exec("DELETE FROM maintainers WHERE name = ? AND maintainer = ?", name, m); err != nil {
+			return nil, fmt.Errorf("removing maintainer of %s: %w", name, err)
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO packages (name, last_seen) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET last_seen = excluded.last_seen`, name, now)
+	if err != nil {
+		return nil, fmt.Errorf("recording %s: %w", name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("updating maintainers of %s: %w", name, err)
+	}
+	if !known {
+		return nil, nil
+	}
+	return added, nil
+}
+
+// Save does nothing: every change is written as it is made.
+func (s *SQLiteStore) Save() error {
+	return nil
+}
+
+func (s *SQLiteStore) List(f SeenFilter) ([]SeenRecord, error) {
+	query := `SELECT s.key, s.target, s.sent_at, v.verdict, v.score, v.reasons
+		FROM seen s LEFT JOIN verdicts v ON v.key = s.key WHERE 1 = 1`
+	var args []any
+	if f.Target != "" {
+		query += " AND s.target = ?"
+		args = append(args, f.Target)
+	}
+	if f.Verdicts != nil {
+		query += " AND v.verdict IN (NULL" + strings.Repeat(", ?", len(f.Verdicts)) + ")"
+		for _, v := range f.Verdicts {
+			args = append(args, v)
+		}
+	}
+	query += " ORDER BY s.sent_at DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing seen packages: %w", err)
+	}
+	defer rows.Close()
+	var records []SeenRecord
+	for rows.Next() {
+		var (
+			r       SeenRecord
+			sentAt  string
+			verdict sql.NullString
+			score   sql.NullFloat64
+			reasons sql.NullString
+		)
+		if err := rows.Scan(&r.Package, &r.Target, &sentAt, &verdict, &score, &reasons); err != nil {
+			return nil, fmt.Errorf("listing seen packages: %w", err)
+		}
+		r.SentAt, _ = time.Parse(time.RFC3339, sentAt)
+		if verdict.Valid {
+			r.Result = &ScanResult{Verdict: verdict.String, Score: score.Float64}
+			if err := json.Unmarshal([]byte(reasons.String), &r.Result.Reasons); err != nil {
+				return nil, fmt.Errorf("unmarshalling reasons for %s: %w", r.Package, err)
+			}
+		}
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing seen packages: %w", err)
+	}
+	return records, nil
+}
+
+// AddFinding keeps the whole finding as JSON, alongside the columns
+// Findings filters on.
+func (s *SQLiteStore) AddFinding(r FindingRecord) error {
+	key := seenKey(r.Package)
+	b, err := json.Marshal(r.Finding)
+	if err != nil {
+		return fmt.Errorf("marshalling finding for %s: %w", key, err)
+	}
+	_, err = s.db.Exec("INSERT INTO findings (target, key, found_at, score, finding) VALUES (?, ?, ?, ?, ?)",
+		r.Target, key, r.FoundAt.UTC().Format(foundAtLayout), r.Result.Score, string(b))
+	if err != nil {
+		return fmt.Errorf("recording finding for %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Findings(f FindingFilter) ([]FindingRecord, error) {
+	// found_at is compared as text, which orders correctly as every value
+	// is in UTC and of the same width
+	query := "SELECT found_at, finding FROM findings WHERE 1 = 1"
+	var args []any
+	if f.Target != "" {
+		query += " AND target = ?"
+		args = append(args, f.Target)
+	}
+	if f.MinScore != 0 {
+		query += " AND score >= ?"
+		args = append(args, f.MinScore)
+	}
+	if !f.Since.IsZero() {
+		query += " AND found_at >= ?"
+		args = append(args, f.Since.UTC().Format(foundAtLayout))
+	}
+	if !f.Until.IsZero() {
+		query += " AND found_at <= ?"
+		args = append(args, f.Until.UTC().Format(foundAtLayout))
+	}
+	query += " ORDER BY found_at DESC, id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing findings: %w", err)
+	}
+	defer rows.Close()
+	var records []FindingRecord
+	for rows.Next() {
+		var (
+			r                FindingRecord
+			foundAt, finding string
+		)
+		if err := rows.Scan(&foundAt, &finding); err != nil {
+			return nil, fmt.Errorf("listing findings: %w", err)
+		}
+		r.FoundAt, _ = time.Parse(foundAtLayout, foundAt)
+		if err := json.Unmarshal([]byte(finding), &r.Finding); err != nil {
+			return nil, fmt.Errorf("unmarshalling finding: %w", err)
+		}
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing findings: %w", err)
+	}
+	return records, nil
+}
+
+func (s *SQLiteStore) Len() int {
+	var n int
+	if err := s.db.QueryRow("SELECT count(*) FROM seen").Scan(&n); err != nil {
+		return 0
+	}
+	return n
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests in this file are meant to be run with -race.
+
+var storeKinds = []struct{ kind, file string }{
+	{kind: "json", file: "seen.json"},
+	{kind: "sqlite", file: "seen.db"},
+}
+
+func TestStoreConcurrent(t *testing.T) {
+	const goroutines, packages = 8, 40
+	for _, sk := range storeKinds {
+		t.Run(sk.kind, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), sk.file)
+			s, err := OpenStore(sk.kind, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// every goroutine records every package, in a different
+			// order, checking and updating maintainers as it goes
+			var wg sync.WaitGroup
+			for g := range goroutines {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range packages {
+						p := Package{Name: fmt.Sprintf("pkg-%02d", (i+g)%packages), Version: "1.0.0"}
+						if _, err := s.Has(p, "scanner"); err != nil {
+							t.Error(err)
+						}
+						if err := s.Add(p, "foo", []string{"scanner"}, &ScanResult{Verdict: "benign"}); err != nil {
+							t.Error(err)
+						}
+						if _, err := s.UpdateMaintainers(p.Name, []string{fmt.Sprintf("m%d", g)}); err != nil {
+							t.Error(err)
+						}
+						if g%4 == 0 {
+							if err := s.Save(); err != nil {
+								t.Error(err)
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			if err := s.Save(); err != nil {
+				t.Fatal(err)
+			}
+			if n := s.Len(); n != packages {
+				t.Errorf("Len = %d, want %d", n, packages)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// what was saved is what was recorded
+			s, err = OpenStore(sk.kind, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			records, err := s.List(SeenFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != packages {
+				t.Errorf("reopened store lists %d records, want %d", len(records), packages)
+			}
+			for i := range packages {
+				p := Package{Name: fmt.Sprintf("pkg-%02d", i), Version: "1.0.0"}
+				if ok, err := s.Has(p, "scanner"); err != nil || !ok {
+					t.Errorf("Has(%s) = %v, %v after reopening", seenKey(p), ok, err)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentSubmissions(t *testing.T) {
+	// foo and bar share most of their dependents, listed in opposite
+	// orders so that the runs meet part way through, and are triaged at
+	// once, as targets on the same schedule are. Each lists its own
+	// dependents first.
+	var shared, fooOnly, barOnly []Package
+	for i := range 150 {
+		shared = append(shared, Package{Name: fmt.Sprintf("shared-%03d", i), Date: ago(time.Hour)})
+	}
+	for i := range 10 {
+		fooOnly = append(fooOnly, Package{Name: fmt.Sprintf("foo-%02d", i), Date: ago(time.Hour)})
+		barOnly = append(barOnly, Package{Name: fmt.Sprintf("bar-%02d", i), Date: ago(time.Hour)})
+	}
+	reversed := slices.Clone(shared)
+	slices.Reverse(reversed)
+	for _, sk := range storeKinds {
+		t.Run(sk.kind, func(t *testing.T) {
+			h := newHarness(t, slices.Concat(fooOnly, shared)...)
+			h.npm.others = map[string][]Package{"bar": slices.Concat(barOnly, reversed)}
+			// neither run gets past its own dependents until the other
+			// has started submitting, so they are sure to overlap
+			started := map[string]chan struct{}{"foo": make(chan struct{}), "bar": make(chan struct{})}
+			once := map[string]*sync.Once{"foo": new(sync.Once), "bar": new(sync.Once)}
+			h.scanner.respond = func(name string, _ int) int {
+				target, _, _ := strings.Cut(name, "-")
+				if other, ok := map[string]string{"foo": "bar", "bar": "foo"}[target]; ok {
+					once[target].Do(func() { close(started[target]) })
+					select {
+					case <-started[other]:
+					case <-time.After(5 * time.Second):
+						t.Errorf("%s was sent before any of %s's dependents", name, other)
+					}
+				}
+				time.Sleep(time.Millisecond)
+				return http.StatusOK
+			}
+			c := h.config(map[string]any{
+				"target":     []string{"foo", "bar"},
+				"store":      sk.kind,
+				"store_path": filepath.Join(h.dir, sk.file),
+				"workers":    8,
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var wg sync.WaitGroup
+			errs := make([]error, len(c.Target))
+			for i, target := range c.Target {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs[i] = c.runTriage(ctx, Targets{target})
+				}()
+			}
+			wg.Wait()
+			if err := errors.Join(errs...); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			// a second run over the same window sends nothing more
+			if err := h.run(c); err != nil {
+				t.Fatalf("second run failed: %v", err)
+			}
+			all := slices.Concat(shared, fooOnly, barOnly)
+			for _, p := range all {
+				if n := h.scanner.count(p.Name); n != 1 {
+					t.Errorf("%s sent %d times, want 1", p.Name, n)
+				}
+			}
+			if n := c.Store.Len(); n != len(all) {
+				t.Errorf("store holds %d packages, want %d", n, len(all))
+			}
+		})
+	}
+}
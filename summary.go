@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+)
+
+// RunSummary describes what a triage run of a single target did.
+type RunSummary struct {
+	Target string    `json:"target"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	// Returned is the number of dependents npm listed for the target.
+	Returned int `json:"returned"`
+	// Transitive is the number of dependents of dependents listed, with depth
+	// above 1. They all go through the same checks as direct dependents.
+	Transitive int `json:"transitive"`
+	// TooNew is the number published since the cutoff but more recently than
+	// min_age, left for a later run.
+	TooNew int `json:"too_new"`
+	// InWindow is the number published between the cutoff and min_age ago.
+	InWindow int `json:"in_window"`
+	// Scoped is the number of in-window dependents skipped for being scoped.
+	Scoped int `json:"scoped"`
+	// Allowlisted is the number of in-window dependents skipped because all
+	// their maintainers are allowlisted.
+	Allowlisted int `json:"allowlisted"`
+	// Denylisted is the number of dependents with a denylisted maintainer,
+	// which are considered whatever their publish date.
+	Denylisted int `json:"denylisted"`
+	// Typosquats is the number of dependents whose names are near misses of
+	// popular packages, which are considered whatever their publish date.
+	Typosquats int `json:"typosquats"`
+	// NameFiltered is the number of dependents skipped by the name
+	// patterns.
+	NameFiltered int `json:"name_filtered"`
+	// Ignored is the number of dependents skipped for being on the ignore
+	// list.
+	Ignored int `json:"ignored"`
+	// Watched is the number of dependents whose description matched the
+	// keyword watchlist. They are also counted under the other fields.
+	Watched int `json:"watched"`
+	// TooManyMaintainers is the number of in-window dependents skipped for
+	// having more than max_maintainers maintainers.
+	TooManyMaintainers int `json:"too_many_maintainers"`
+	// AlreadySent is the number of in-window dependents that had been sent
+	// on an earlier run.
+	AlreadySent int `json:"already_sent"`
+	// Capped is the number left for a later run by max_per_run.
+	Capped  int    `json:"capped"`
+	Sent    int    `json:"sent"`
+	Errored int    `json:"errored"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (s *RunSummary) log() {
+	slog.Info("run summary", "target", s.Target, "duration", s.End.Sub(s.Start),
+		"returned", s.Returned, "transitive", s.Transitive, "too_new", s.TooNew, "in_window", s.InWindow, "scoped", s.Scoped,
+		"allowlisted", s.Allowlisted, "denylisted", s.Denylisted,
+		"typosquats", s.Typosquats, "name_filtered", s.NameFiltered, "ignored", s.Ignored, "watched", s.Watched,
+		"too_many_maintainers", s.TooManyMaintainers, "already_sent", s.AlreadySent, "capped", s.Capped,
+		"sent", s.Sent, "errored", s.Errored, "error", s.Error)
+}
+
+// lastSummaries holds the most recent RunSummary of each target.
+var lastSummaries summaryLog
+
+type summaryLog struct {
+	mu      sync.Mutex
+	summary map[string]*RunSummary
+}
+
+func (l *summaryLog) record(s *RunSummary) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.summary == nil {
+		l.summary = make(map[string]*RunSummary)
+	}
+	l.summary[s.Target] = s
+}
+
+// get returns the latest summary of every target that has run.
+func (l *summaryLog) get() map[string]*RunSummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return maps.Clone(l.summary)
+}
+
+// defaultRunHistory is how many run summaries recentRuns keeps by default.
+const defaultRunHistory = 50
+
+// recentRuns holds the latest RunSummary results of all targets, for
+// debugging without a persistent store.
+var recentRuns runHistory
+
+// runHistory is a ring buffer of run summaries.
+type runHistory struct {
+	mu   sync.Mutex
+	runs []*RunSummary
+	// next is the index the next summary is written to once runs is full.
+	next int
+	size int
+}
+
+// setSize sets how many summaries are kept. It must be called before the
+// first record.
+func (h *runHistory) setSize(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.size = n
+}
+
+func (h *runHistory) record(s *RunSummary) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.size == 0 {
+		h.size = defaultRunHistory
+	}
+	if len(h.runs) < h.size {
+		h.runs = append(h.runs, s)
+		return
+	}
+	h.runs[h.next] = s
+	h.next = (h.next + 1) % h.size
+}
+
+// get returns up to limit of the kept summaries, most recent first, optionally
+// only those of target.
+func (h *runHistory) get(target string, limit int) []*RunSummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	runs := []*RunSummary{}
+	for i := range h.runs {
+		// walk back from the newest, which is just before next
+		s := h.runs[(h.next-1-i+2*len(h.runs))%len(h.runs)]
+		if target != "" && s.Target != target {
+			continue
+		}
+		if len(runs) == limit {
+			break
+		}
+		runs = append(runs, s)
+	}
+	return runs
+}
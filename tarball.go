@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultMaxTarballBytes is the largest tarball downloaded by default. Few
+// packages come close; those that do are rarely the kind worth scanning.
+const defaultMaxTarballBytes = 50 << 20
+
+// errTarballTooLarge is returned by FetchTarball for tarballs bigger than the
+// size cap. Such packages are left for a human to look at.
+var errTarballTooLarge = errors.New("tarball is larger than max_tarball_bytes")
+
+// Tarball is a package tarball downloaded from the registry.
+type Tarball struct {
+	URL string
+	// Integrity is the subresource integrity string of Data, as published in
+	// the registry metadata, e.g. sha512-<base64>.
+	Integrity string
+	Data      []byte
+}
+
+// TarballFetcher downloads package tarballs.
+type TarballFetcher interface {
+	// FetchTarball returns the tarball of version of name, or of its latest
+	// version if version is empty.
+	FetchTarball(ctx context.Context, name, version string) (*Tarball, error)
+}
+
+// TarballSubmitter uploads package tarballs for analysis.
+type TarballSubmitter interface {
+	SubmitTarball(ctx context.Context, packageName string, t *Tarball) (*ScanResult, error)
+}
+
+// versionDist is the part of a package version's registry metadata that
+// describes its tarball.
+type versionDist struct {
+	Dist struct {
+		Tarball   string `json:"tarball"`
+		Integrity string `json:"integrity"`
+		Shasum    string `json:"shasum"`
+	} `json:"dist"`
+}
+
+// FetchTarball looks up the tarball URL of name at version in the registry
+// metadata at MetadataURL and downloads it, sharing the rate limit with
+// FetchDependents. Tarballs over MaxTarballBytes are not downloaded, or not
+// past the cap if the registry does not say how big they are, and return
+// errTarballTooLarge. The download is checked against the published integrity
+// before it is returned.
+func (f *NPMFetcher) FetchTarball(ctx context.Context, name, version string) (*Tarball, error) {
+	if version == "" {
+		version = "latest"
+	}
+	// the registry takes scoped names with the slash escaped, as in
+	// @scope%2Fname
+	u := f.MetadataURL + url.PathEscape(name) + "/" + url.PathEscape(version)
+	res, err := f.get(ctx, u, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var dist versionDist
+	if err := json.NewDecoder(res.Body).Decode(&dist); err != nil {
+		return nil, fmt.Errorf("%w from %s: %w", ErrDecodeFailure, redactUserinfo(res.Request.URL.String()), err)
+	}
+	if dist.Dist.Tarball == "" {
+		return nil, fmt.Errorf("%w from %s: no tarball url", ErrDecodeFailure, redactUserinfo(res.Request.URL.String()))
+	}
+
+	res, err = f.get(ctx, dist.Dist.Tarball, "application/octet-stream")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.ContentLength > f.MaxTarballBytes {
+		return nil, fmt.Errorf("%s is %d bytes: %w", dist.Dist.Tarball, res.ContentLength, errTarballTooLarge)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, f.MaxTarballBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: downloading %s: %w", ErrUpstreamUnavailable, dist.Dist.Tarball, err)
+	}
+	if int64(len(data)) > f.MaxTarballBytes {
+		return nil, fmt.Errorf("%s is over %d bytes: %w", dist.Dist.Tarball, f.MaxTarballBytes, errTarballTooLarge)
+	}
+	if err := checkIntegrity(data, dist.Dist.Integrity, dist.Dist.Shasum); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrDecodeFailure, dist.Dist.Tarball, err)
+	}
+	return &Tarball{URL: dist.Dist.Tarball, Integrity: dist.Dist.Integrity, Data: data}, nil
+}
+
+// get requests u from the registry and returns the response if it is a 200.
+func (f *NPMFetcher) get(ctx context.Context, u, accept string) (*http.Response, error) {
+	if f.Limiter != nil {
+		if err := f.Limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating registry request: %w", err)
+	}
+	req.Header.Add("accept", accept)
+	req.Header.Add("user-agent", f.UserAgent)
+	res, err := f.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: doing request for %s: %w", ErrUpstreamUnavailable, redactUserinfo(req.URL.String()), redactURLError(err))
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, &statusError{code: res.StatusCode, url: redactUserinfo(res.Request.URL.String())}
+	}
+	return res, nil
+}
+
+// checkIntegrity checks data against its sha512 subresource integrity string,
+// or failing that its hex sha1 shasum, which is all old packages were
+// published with.
+func checkIntegrity(data []byte, integrity, shasum string) error {
+	if digest, ok := strings.CutPrefix(integrity, "sha512-"); ok {
+		want, err := base64.StdEncoding.DecodeString(digest)
+		if err != nil {
+			return fmt.Errorf("decoding integrity: %w", err)
+		}
+		if got := sha512.Sum512(data); !bytes.Equal(got[:], want) {
+			return errors.New("tarball does not match its sha512 integrity")
+		}
+		return nil
+	}
+	if shasum == "" {
+		return errors.New("no sha512 integrity or shasum to check the tarball against")
+	}
+	if got := sha1.Sum(data); hex.EncodeToString(got[:]) != strings.ToLower(shasum) {
+		return errors.New("tarball does not match its shasum")
+	}
+	return nil
+}
+
+// tarballScanner uploads the tarball of packages the embedded Scanner responds
+// 404 for, which it could not find itself, to upload. It backs scan_tarballs.
+type tarballScanner struct {
+	Scanner
+	fetcher TarballFetcher
+	upload  TarballSubmitter
+}
+
+// Submit submits packageName, which may be name@version, to the embedded
+// Scanner and falls back to uploading its tarball if the scanner could not
+// find it. Should the tarball be too large or fail to download, the scanner's
+// error is returned, so that the package is dead-lettered and a registry
+// outage does not count against the scanner's circuit breaker.
+func (t *tarballScanner) Submit(ctx context.Context, packageName string) (*ScanResult, error) {
+	result, err := t.Scanner.Submit(ctx, packageName)
+	var se *statusError
+	if !errors.As(err, &se) || se.code != http.StatusNotFound {
+		return result, err
+	}
+	name, version := splitScanName(packageName)
+	tb, ferr := t.fetcher.FetchTarball(ctx, name, version)
+	if ferr != nil {
+		outcome := "fetch_failed"
+		if errors.Is(ferr, errTarballTooLarge) {
+			outcome = "too_large"
+			slog.Warn("tarball too large to upload to scanner", "package", packageName, "error", ferr)
+		}
+		tarballUploads.WithLabelValues(outcome).Inc()
+		return nil, fmt.Errorf("%w; tarball not uploaded: %v", err, ferr)
+	}
+	slog.Debug("uploading tarball to scanner", "package", packageName, "url", tb.URL, "bytes", len(tb.Data))
+	result, err = t.upload.SubmitTarball(ctx, packageName, tb)
+	if err != nil {
+		tarballUploads.WithLabelValues("upload_failed").Inc()
+		return nil, err
+	}
+	tarballUploads.WithLabelValues("uploaded").Inc()
+	return result, nil
+}
+
+// splitScanName splits what scanName returns back into the package name and
+// version, which is empty if there is none. The @ of a scope is not taken for
+// a version.
+func splitScanName(s string) (name, version string) {
+	if i := strings.LastIndex(s, "@"); i > 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
@@ -0,0 +1,50 @@
+package main
+
+// defaultTyposquatDistance is the largest edit distance from a popular
+// package name at which a dependent is treated as a possible typosquat.
+const defaultTyposquatDistance = 2
+
+// typosquatOf returns the popular package that name is a near miss of, and
+// the edit distance between them. Names identical to a popular package are
+// the package itself and never match.
+func (c *Config) typosquatOf(name string) (popular string, distance int, ok bool) {
+	for _, candidate := range c.PopularPackages {
+		if candidate == name || abs(len(candidate)-len(name)) > c.TyposquatDistance {
+			continue
+		}
+		if d := levenshtein(name, candidate); d <= c.TyposquatDistance && (!ok || d < distance) {
+			popular, distance, ok = candidate, d, true
+		}
+	}
+	return popular, distance, ok
+}
+
+// levenshtein returns the number of single character insertions, deletions
+// and substitutions needed to turn a into b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
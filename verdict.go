@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// ScanResult is the scanner's analysis of a package.
+type ScanResult struct {
+	Verdict string   `json:"verdict"`
+	Score   float64  `json:"score"`
+	Reasons []string `json:"reasons"`
+}
+
+// severities orders the verdicts the scanner returns. Verdicts not listed
+// here are unknown and never trigger a notification.
+var severities = map[string]int{
+	"benign":     0,
+	"suspicious": 1,
+	"malicious":  2,
+}
+
+const defaultSeverityThreshold = "suspicious"
+
+// AtLeast reports whether the verdict is at least as severe as threshold.
+func (r *ScanResult) AtLeast(threshold string) bool {
+	got, ok := severities[r.Verdict]
+	return ok && got >= severities[threshold]
+}
+
+// verdictLabel returns the verdict for metrics, collapsing those not in
+// severities, and a nil result, to "unknown".
+func (r *ScanResult) verdictLabel() string {
+	if r == nil {
+		return "unknown"
+	}
+	if _, ok := severities[r.Verdict]; !ok {
+		return "unknown"
+	}
+	return r.Verdict
+}
+
+// mostSevere returns the most severe of results, ignoring nil ones. It returns
+// nil if there are none.
+func mostSevere(results []*ScanResult) *ScanResult {
+	var worst *ScanResult
+	for _, r := range results {
+		if r != nil && (worst == nil || severities[r.Verdict] > severities[worst.Verdict]) {
+			worst = r
+		}
+	}
+	return worst
+}
+
+// Finding is a package that is worth alerting on: either the scanner's
+// verdict met the severity threshold, or NewMaintainers lists maintainers that
+// have appeared since the package was last seen.
+type Finding struct {
+	Target         string     `json:"target"`
+	Package        Package    `json:"package"`
+	Result         ScanResult `json:"result"`
+	NewMaintainers []string   `json:"new_maintainers,omitempty"`
+}
+
+// Notifier delivers findings to an external system.
+type Notifier interface {
+	Notify(f Finding) error
+}
+
+// notify records f in the store and then passes it to every configured
+// notifier, so that it is on record even if no notifier can be reached.
+// Failures are logged rather than returned so that an unreachable notifier
+// never aborts a run. A dry run does neither.
+func (c *Config) notify(f Finding) {
+	if c.DryRun {
+		return
+	}
+	if err := c.Store.AddFinding(FindingRecord{FoundAt: time.Now().UTC(), Finding: f}); err != nil {
+		slog.Error("recording finding", "target", f.Target, "package", f.Package.Name, "error", err)
+	}
+	for _, n := range c.Notifiers {
+		if err := n.Notify(f); err != nil {
+			slog.Error("sending notification", "target", f.Target, "package", f.Package.Name, "error", err)
+		}
+	}
+}